@@ -92,7 +92,7 @@ func CheckLoginMw(url string, option CheckLoginOption) gin.HandlerFunc {
 			return
 		}
 		
-		logs.CtxInfof(c, "url: %v token: %v", url, token)
+		logs.CtxInfof(c, "CheckLoginMw url: %v has_token: %v", url, !IsTokenEmpty(token))
 		
 		if !IsTokenEmpty(token) {
 			resp, err := getVerifyTokenResp(c, url, token, option.Timeout)
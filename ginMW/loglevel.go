@@ -0,0 +1,54 @@
+package ginMW
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/gin-gonic/gin"
+)
+
+// LogLevelHandler 运行时查看和修改日志级别，controller 为空时使用 logs.DefaultLevelController
+// GET 返回所有 logger 的级别；POST/PUT 参数 name、level、ttl(如 10m，0 表示永久)；DELETE 参数 name 恢复默认
+// name 必须是已通过 logs.Named 创建的 logger，否则返回 404
+// 没有鉴权，需要注册在管理路由下，如 r.Any("/admin/log/level", mw, LogLevelHandler(nil))
+func LogLevelHandler(controller *logs.LevelController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lc := controller
+		if lc == nil {
+			lc = logs.DefaultLevelController()
+		}
+		if lc == nil {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "logger not support level control"})
+			return
+		}
+		ctx := c.Request.Context()
+		name := c.Query("name")
+		switch c.Request.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			if err := lc.Apply(name, c.Query("level"), c.Query("ttl")); err != nil {
+				c.JSON(levelErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			logs.CtxWarnf(ctx, "LogLevelHandler set name=%v level=%v ttl=%v uid=%v", name, c.Query("level"), c.Query("ttl"), GetTokenUid(c))
+		case http.MethodDelete:
+			if err := lc.Reset(name); err != nil {
+				c.JSON(levelErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			logs.CtxWarnf(ctx, "LogLevelHandler reset name=%v uid=%v", name, GetTokenUid(c))
+		default:
+			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "method not allowed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"levels": lc.Levels()})
+	}
+}
+
+func levelErrorStatus(err error) int {
+	if errors.Is(err, logs.ErrLoggerNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
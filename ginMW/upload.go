@@ -0,0 +1,27 @@
+package ginMW
+
+import (
+	"net/http"
+
+	"github.com/EICHI-X/ptools/oss"
+	"github.com/gin-gonic/gin"
+)
+
+// UploadHandler 表单上传接口，支持单个或多个文件，返回 {"files": [oss.UploadedFile]}
+// 上传权限使用 GetTokenUid 取到的 uid 检查，需要放在 CheckLoginMw 之后
+func UploadHandler(cfg oss.UploadHandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "multipart form not valid"})
+			return
+		}
+		files := form.File[cfg.FormFieldName()]
+		uid := GetTokenUid(c)
+		if code, err := cfg.CheckUpload(c.Request.Context(), uid, files); err != nil {
+			c.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"files": cfg.UploadFiles(c.Request.Context(), uid, files)})
+	}
+}
@@ -0,0 +1,229 @@
+package hertzmiddleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/oss"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/minio/minio-go/v7"
+)
+
+// DownloadProxyConfig 私有 bucket 下载代理配置，内容经服务端转发，不对外暴露签名地址
+type DownloadProxyConfig struct {
+	Loader         *oss.OssLoader
+	AllowedBuckets []string // 为空表示不限制
+	// Authorize 鉴权回调，uid 来自 GetTokenUid，返回错误时拒绝下载
+	Authorize func(c context.Context, ctx *app.RequestContext, uid string, bucket string, object string) error
+	// Filename 下载文件名，为空时使用对象名的最后一段
+	Filename func(bucket string, object string, stat *minio.ObjectInfo) string
+	Inline   bool          // Content-Disposition 使用 inline，浏览器可直接预览
+	MaxAge   time.Duration // Cache-Control private max-age，0 表示 no-cache
+}
+
+// DownloadProxyHandler 鉴权后流式返回对象，支持单段 Range、If-None-Match、If-Modified-Since 和 If-Range
+// 路由示例 h.GET("/download/:bucket/*object", DownloadProxyHandler(cfg))
+func DownloadProxyHandler(cfg DownloadProxyConfig) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		bucket := ctx.Param("bucket")
+		object := strings.TrimPrefix(ctx.Param("object"), "/")
+		if bucket == "" || object == "" || strings.Contains(object, "..") {
+			ctx.String(http.StatusBadRequest, "object not valid")
+			return
+		}
+		if len(cfg.AllowedBuckets) > 0 && !containsStr(cfg.AllowedBuckets, bucket) {
+			ctx.String(http.StatusForbidden, "bucket not allowed")
+			return
+		}
+		uid := GetTokenUid(c, ctx)
+		if cfg.Authorize == nil {
+			ctx.String(http.StatusForbidden, "download not allowed")
+			return
+		}
+		if err := cfg.Authorize(c, ctx, uid, bucket, object); err != nil {
+			logs.CtxWarnf(c, "DownloadProxyHandler uid=%v bucket=%v object=%v denied %v", uid, bucket, object, err)
+			ctx.String(http.StatusForbidden, "download not allowed")
+			return
+		}
+
+		obj, err := cfg.Loader.DownLoadFile(c, bucket, object)
+		if err != nil {
+			logs.CtxErrorf(c, "DownloadProxyHandler get object fail %v", err)
+			ctx.String(http.StatusInternalServerError, "storage not available")
+			return
+		}
+		stat, err := obj.Stat()
+		if err != nil {
+			obj.Close()
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				ctx.String(http.StatusNotFound, "object not found")
+				return
+			}
+			logs.CtxErrorf(c, "DownloadProxyHandler stat bucket=%v object=%v fail %v", bucket, object, err)
+			ctx.String(http.StatusInternalServerError, "storage not available")
+			return
+		}
+
+		etag := "\"" + strings.Trim(stat.ETag, "\"") + "\""
+		header := &ctx.Response.Header
+		header.Set("ETag", etag)
+		header.Set("Last-Modified", stat.LastModified.UTC().Format(http.TimeFormat))
+		header.Set("Accept-Ranges", "bytes")
+		if cfg.MaxAge > 0 {
+			header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(cfg.MaxAge/time.Second)))
+		} else {
+			header.Set("Cache-Control", "private, no-cache")
+		}
+		if notModified(ctx, etag, stat.LastModified) {
+			obj.Close()
+			ctx.SetStatusCode(http.StatusNotModified)
+			return
+		}
+
+		filename := path.Base(object)
+		if cfg.Filename != nil {
+			filename = cfg.Filename(bucket, object, &stat)
+		}
+		header.Set("Content-Disposition", ContentDisposition(filename, cfg.Inline))
+		contentType := stat.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		ctx.SetContentType(contentType)
+
+		start, length, ok := parseRange(string(ctx.GetHeader("Range")), stat.Size)
+		// If-Range 与当前版本不一致时返回完整内容
+		if ifRange := string(ctx.GetHeader("If-Range")); ifRange != "" && ifRange != etag {
+			start, length, ok = 0, stat.Size, true
+		}
+		if !ok {
+			obj.Close()
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", stat.Size))
+			ctx.SetStatusCode(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status := http.StatusOK
+		if length != stat.Size {
+			if _, err := obj.Seek(start, io.SeekStart); err != nil {
+				obj.Close()
+				ctx.String(http.StatusInternalServerError, "seek fail")
+				return
+			}
+			status = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, stat.Size))
+		}
+		logs.CtxInfof(c, "DownloadProxyHandler uid=%v bucket=%v object=%v start=%v length=%v", uid, bucket, object, start, length)
+		ctx.SetStatusCode(status)
+		// hertz 在响应结束后会关闭实现了 io.Closer 的 body stream
+		ctx.SetBodyStream(struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(obj, length), obj}, int(length))
+	}
+}
+
+// notModified If-None-Match 优先，没有时才使用 If-Modified-Since
+func notModified(ctx *app.RequestContext, etag string, lastModified time.Time) bool {
+	if inm := string(ctx.GetHeader("If-None-Match")); inm != "" {
+		if strings.TrimSpace(inm) == "*" {
+			return true
+		}
+		for _, v := range strings.Split(inm, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(v), "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := string(ctx.GetHeader("If-Modified-Since")); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange 只支持单段 bytes=a-b、bytes=a-、bytes=-n，多段或无法解析时返回完整内容，超出范围返回 false
+func parseRange(s string, size int64) (int64, int64, bool) {
+	if s == "" || !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, size, true
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(s, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, true
+	}
+	startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if startStr == "" {
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, size, true
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if endStr != "" {
+		e, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || e < start {
+			return 0, size, true
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// ContentDisposition 生成 Content-Disposition，filename 为 ascii 兜底，filename* 按 RFC 5987 编码支持中文
+func ContentDisposition(filename string, inline bool) string {
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	var fallback strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+			continue
+		}
+		fallback.WriteRune(r)
+	}
+	return fmt.Sprintf("%v; filename=\"%v\"; filename*=UTF-8''%v", disposition, fallback.String(), rfc5987Escape(filename))
+}
+
+func rfc5987Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
@@ -0,0 +1,250 @@
+package hertzmiddleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/oss"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/minio/minio-go/v7"
+)
+
+const variantSourceEtagMeta = "Source-Etag"
+
+// ImageResizeConfig 图片裁剪接口配置，只允许配置内的尺寸，防止被刷任意尺寸占满存储
+// AllowedBuckets 和 Authorize 都为空时拒绝所有请求
+type ImageResizeConfig struct {
+	Loader         *oss.OssLoader
+	AllowedBuckets []string // 公开 bucket，不需要鉴权，返回 Cache-Control public
+	// Authorize 不在 AllowedBuckets 中的 bucket 的鉴权回调，uid 来自 GetTokenUid，为空或返回错误时拒绝，通过时返回 Cache-Control private
+	Authorize      func(c context.Context, ctx *app.RequestContext, uid string, bucket string, object string) error
+	AllowedWidths  []int         // 允许的宽度，0 总是允许(表示按高度等比缩放)
+	AllowedHeights []int         // 允许的高度，0 总是允许(表示按宽度等比缩放)
+	AllowedFormats []string      // 允许的输出格式，默认 jpeg、png
+	VariantPrefix  string        // 生成的图片保存的前缀，默认 _variants/
+	Quality        int           // jpeg 质量，默认 oss.DefaultJpegQuality
+	MaxAge         time.Duration // Cache-Control max-age，默认 30 天
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStr(list []string, v string) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+type imageResizeParam struct {
+	bucket string
+	object string
+	width  int
+	height int
+	fit    string
+	format string
+}
+
+func (cfg *ImageResizeConfig) parse(ctx *app.RequestContext) (*imageResizeParam, error) {
+	p := &imageResizeParam{
+		bucket: ctx.Param("bucket"),
+		object: strings.TrimPrefix(ctx.Param("object"), "/"),
+		fit:    ctx.Query("fit"),
+		format: strings.ToLower(ctx.Query("fmt")),
+	}
+	if p.bucket == "" || p.object == "" || strings.Contains(p.object, "..") {
+		return nil, fmt.Errorf("object not valid")
+	}
+	var err error
+	if w := ctx.Query("w"); w != "" {
+		if p.width, err = strconv.Atoi(w); err != nil {
+			return nil, fmt.Errorf("w not valid")
+		}
+	}
+	if h := ctx.Query("h"); h != "" {
+		if p.height, err = strconv.Atoi(h); err != nil {
+			return nil, fmt.Errorf("h not valid")
+		}
+	}
+	if p.width < 0 || p.height < 0 || (p.width == 0 && p.height == 0) {
+		return nil, fmt.Errorf("w or h must be set")
+	}
+	if p.width > 0 && !containsInt(cfg.AllowedWidths, p.width) {
+		return nil, fmt.Errorf("w %v not allowed", p.width)
+	}
+	if p.height > 0 && !containsInt(cfg.AllowedHeights, p.height) {
+		return nil, fmt.Errorf("h %v not allowed", p.height)
+	}
+	switch p.fit {
+	case "":
+		p.fit = oss.FitContain
+	case oss.FitContain, oss.FitCover, oss.FitFill:
+	default:
+		return nil, fmt.Errorf("fit %v not allowed", p.fit)
+	}
+	if p.format == "jpg" {
+		p.format = oss.ImageFormatJpeg
+	}
+	if p.format != "" {
+		formats := cfg.AllowedFormats
+		if len(formats) == 0 {
+			formats = []string{oss.ImageFormatJpeg, oss.ImageFormatPng}
+		}
+		if !containsStr(formats, p.format) {
+			return nil, fmt.Errorf("fmt %v not allowed", p.format)
+		}
+	}
+	return p, nil
+}
+
+func (cfg *ImageResizeConfig) variantKey(p *imageResizeParam) string {
+	prefix := cfg.VariantPrefix
+	if prefix == "" {
+		prefix = "_variants/"
+	}
+	format := p.format
+	if format == "" {
+		format = "auto"
+	}
+	return fmt.Sprintf("%v%v/w%v_h%v_%v.%v", prefix, p.object, p.width, p.height, p.fit, format)
+}
+
+// ImageResizeHandler 按需生成缩略图，路由示例 h.GET("/img/:bucket/*object", ImageResizeHandler(cfg))
+// GET /img/{bucket}/{object}?w=&h=&fit=contain|cover|fill&fmt=jpeg|png
+// 生成的图片保存回 bucket，原图更新后会重新生成；原图宽*高超过 oss.MaxImagePixels 时不解码，返回 413
+// 原图是信封加密的对象时不保存生成的图片，避免在 bucket 中留下明文副本
+// 只有成功和 304 返回缓存头，错误返回 no-store，避免 CDN 缓存错误
+func ImageResizeHandler(cfg ImageResizeConfig) app.HandlerFunc {
+	maxAge := cfg.MaxAge
+	if maxAge <= 0 {
+		maxAge = 30 * 24 * time.Hour
+	}
+	return func(c context.Context, ctx *app.RequestContext) {
+		p, err := cfg.parse(ctx)
+		if err != nil {
+			imageError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		cacheControl := "public"
+		if !containsStr(cfg.AllowedBuckets, p.bucket) {
+			uid := GetTokenUid(c, ctx)
+			if cfg.Authorize == nil {
+				imageError(ctx, http.StatusForbidden, "bucket not allowed")
+				return
+			}
+			if err := cfg.Authorize(c, ctx, uid, p.bucket, p.object); err != nil {
+				logs.CtxWarnf(c, "ImageResizeHandler uid=%v bucket=%v object=%v denied %v", uid, p.bucket, p.object, err)
+				imageError(ctx, http.StatusForbidden, "bucket not allowed")
+				return
+			}
+			cacheControl = "private"
+		}
+		minioClient, err := cfg.Loader.GetClient()
+		if err != nil {
+			logs.CtxErrorf(c, "ImageResizeHandler get client fail %v", err)
+			imageError(ctx, http.StatusInternalServerError, "storage not available")
+			return
+		}
+		srcStat, err := minioClient.StatObject(c, p.bucket, p.object, minio.StatObjectOptions{})
+		if err != nil {
+			imageError(ctx, http.StatusNotFound, "object not found")
+			return
+		}
+		key := cfg.variantKey(p)
+		etagSum := md5.Sum([]byte(srcStat.ETag + "|" + key))
+		etag := "\"" + hex.EncodeToString(etagSum[:]) + "\""
+		setCacheHeaders := func() {
+			ctx.Response.Header.Set("ETag", etag)
+			ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("%v, max-age=%d", cacheControl, int64(maxAge/time.Second)))
+			ctx.Response.Header.Set("Last-Modified", srcStat.LastModified.UTC().Format(http.TimeFormat))
+		}
+		if match := string(ctx.GetHeader("If-None-Match")); match != "" && strings.Contains(match, etag) {
+			setCacheHeaders()
+			ctx.SetStatusCode(http.StatusNotModified)
+			return
+		}
+
+		// 已生成且原图未变化时直接返回
+		encrypted := oss.IsEncrypted(srcStat)
+		if stat, err := minioClient.StatObject(c, p.bucket, key, minio.StatObjectOptions{}); !encrypted && err == nil && stat.UserMetadata[variantSourceEtagMeta] == srcStat.ETag {
+			object, err := minioClient.GetObject(c, p.bucket, key, minio.GetObjectOptions{})
+			if err == nil {
+				setCacheHeaders()
+				ctx.SetContentType(stat.ContentType)
+				ctx.SetBodyStream(object, int(stat.Size))
+				return
+			}
+		}
+
+		data, contentType, err := cfg.generate(c, p)
+		if errors.Is(err, oss.ErrImageTooLarge) {
+			imageError(ctx, http.StatusRequestEntityTooLarge, "image too large")
+			return
+		}
+		if err != nil {
+			logs.CtxErrorf(c, "ImageResizeHandler bucket=%v object=%v fail %v", p.bucket, p.object, err)
+			imageError(ctx, http.StatusUnprocessableEntity, "resize image fail")
+			return
+		}
+		if !encrypted {
+			_, err = minioClient.PutObject(c, p.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+				ContentType:  contentType,
+				UserMetadata: map[string]string{variantSourceEtagMeta: srcStat.ETag},
+			})
+			if err != nil {
+				// 保存失败不影响本次返回
+				logs.CtxWarnf(c, "ImageResizeHandler save variant %v fail %v", key, err)
+			}
+		}
+		setCacheHeaders()
+		ctx.Data(http.StatusOK, contentType, data)
+	}
+}
+
+func imageError(ctx *app.RequestContext, code int, msg string) {
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.String(code, msg)
+}
+
+func (cfg *ImageResizeConfig) generate(c context.Context, p *imageResizeParam) ([]byte, string, error) {
+	object, err := cfg.Loader.DownLoadFile(c, p.bucket, p.object)
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Close()
+	img, srcFormat, err := oss.DecodeImage(io.Reader(object), true)
+	if err != nil {
+		return nil, "", err
+	}
+	format := p.format
+	if format == "" {
+		format = oss.ImageFormatJpeg
+		if srcFormat == oss.ImageFormatPng {
+			format = oss.ImageFormatPng
+		}
+	}
+	resized := oss.ResizeImage(img, p.width, p.height, p.fit)
+	res, err := oss.EncodeImage(resized, format, 0, 0, cfg.Quality, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Data, res.ContentType, nil
+}
@@ -0,0 +1,55 @@
+package hertzmiddleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+)
+
+// LogLevelHandler 运行时查看和修改日志级别，controller 为空时使用 logs.DefaultLevelController
+// GET 返回所有 logger 的级别；POST/PUT 参数 name、level、ttl(如 10m，0 表示永久)；DELETE 参数 name 恢复默认
+// name 必须是已通过 logs.Named 创建的 logger，否则返回 404
+// 没有鉴权，需要注册在管理路由下，如 h.Any("/admin/log/level", mw, LogLevelHandler(nil))
+func LogLevelHandler(controller *logs.LevelController) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		lc := controller
+		if lc == nil {
+			lc = logs.DefaultLevelController()
+		}
+		if lc == nil {
+			ctx.JSON(http.StatusNotImplemented, utils.H{"error": "logger not support level control"})
+			return
+		}
+		name := ctx.Query("name")
+		switch string(ctx.Method()) {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			if err := lc.Apply(name, ctx.Query("level"), ctx.Query("ttl")); err != nil {
+				ctx.JSON(levelErrorStatus(err), utils.H{"error": err.Error()})
+				return
+			}
+			logs.CtxWarnf(c, "LogLevelHandler set name=%v level=%v ttl=%v uid=%v", name, ctx.Query("level"), ctx.Query("ttl"), GetTokenUid(c, ctx))
+		case http.MethodDelete:
+			if err := lc.Reset(name); err != nil {
+				ctx.JSON(levelErrorStatus(err), utils.H{"error": err.Error()})
+				return
+			}
+			logs.CtxWarnf(c, "LogLevelHandler reset name=%v uid=%v", name, GetTokenUid(c, ctx))
+		default:
+			ctx.JSON(http.StatusMethodNotAllowed, utils.H{"error": "method not allowed"})
+			return
+		}
+		ctx.JSON(http.StatusOK, utils.H{"levels": lc.Levels()})
+	}
+}
+
+func levelErrorStatus(err error) int {
+	if errors.Is(err, logs.ErrLoggerNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
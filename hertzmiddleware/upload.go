@@ -0,0 +1,29 @@
+package hertzmiddleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/EICHI-X/ptools/oss"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+)
+
+// UploadHandler 表单上传接口，支持单个或多个文件，返回 {"files": [oss.UploadedFile]}
+// 上传权限使用 GetTokenUid 取到的 uid 检查，需要放在 CheckLoginMw 之后
+func UploadHandler(cfg oss.UploadHandlerConfig) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		form, err := ctx.MultipartForm()
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, utils.H{"error": "multipart form not valid"})
+			return
+		}
+		files := form.File[cfg.FormFieldName()]
+		uid := GetTokenUid(c, ctx)
+		if code, err := cfg.CheckUpload(c, uid, files); err != nil {
+			ctx.JSON(code, utils.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, utils.H{"files": cfg.UploadFiles(c, uid, files)})
+	}
+}
@@ -179,7 +179,8 @@ func CheckLoginMw(url string, option CheckLoginMwOption) []app.HandlerFunc {
 			ctx.JSON(http.StatusUnauthorized, "CheckLogin fail")
 			ctx.AbortWithMsg("未登录", http.StatusUnauthorized)
 		}
-		logs.CtxInfof(c, "ur; %v token: %v, ", url, token)
+		// 不打印 token 原文
+		logs.CtxInfof(c, "CheckLoginMw url: %v has_token: %v", url, !IsTokenEmpty(token))
 		if !IsTokenEmpty(token) {
 			resp, err := getLoginResp(c, url, nil, Hertz, option.Timeout)
 			defer func() {
@@ -0,0 +1,150 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EICHI-X/ptools/env"
+	"github.com/EICHI-X/ptools/pmodel"
+	"go.uber.org/zap"
+)
+
+// 自动添加的字段名，service、env_type、env 每行都有，其余来自 pmodel.GetCommonHeader，只在 Ctx* 日志中添加
+const (
+	FieldUid         = "uid"
+	FieldDeviceId    = "device_id"
+	FieldAppId       = "app_id"
+	FieldVersionCode = "version_code"
+	FieldService     = "service"
+	FieldEnvType     = "env_type"
+	FieldEnv         = "env"
+)
+
+// DefaultEnrichFields 默认自动添加的字段，值为空时不添加
+var DefaultEnrichFields = []string{FieldUid, FieldDeviceId, FieldAppId, FieldVersionCode, FieldService, FieldEnvType, FieldEnv}
+
+type ctxFieldsKey struct{}
+
+// WithFields 把 kv 保存到 ctx 中，之后使用该 ctx 的 Ctx* 日志都会带上这些字段
+// 与 ctx 中已有的字段或自动添加的字段同名时，以后设置的为准；kvs 个数为奇数时忽略最后一个
+func WithFields(ctx context.Context, kvs ...interface{}) context.Context {
+	if len(kvs) < 2 {
+		return ctx
+	}
+	kvs = kvs[:len(kvs)/2*2]
+	keys := make(map[string]bool, len(kvs)/2)
+	for i := 0; i < len(kvs); i += 2 {
+		keys[fieldKey(kvs[i])] = true
+	}
+	old := FieldsFromCtx(ctx)
+	fields := make([]interface{}, 0, len(old)+len(kvs))
+	for i := 0; i < len(old); i += 2 {
+		if !keys[old[i].(string)] {
+			fields = append(fields, old[i], old[i+1])
+		}
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		fields = append(fields, fieldKey(kvs[i]), kvs[i+1])
+	}
+	return context.WithValue(ctx, ctxFieldsKey{}, fields)
+}
+
+// FieldsFromCtx 通过 WithFields 保存的字段，key 都是 string
+func FieldsFromCtx(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(ctxFieldsKey{}).([]interface{})
+	return fields
+}
+
+func fieldKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// WithEnrichFields 自动添加的字段，默认 DefaultEnrichFields，不传表示不添加
+func WithEnrichFields(fields ...string) Option {
+	return option(func(cfg *config) {
+		cfg.enrichFields = fields
+	})
+}
+
+// SetEnrichFields 修改自动添加的字段，同时修改所有子 logger
+func (l *LoggerZap) SetEnrichFields(fields ...string) {
+	l.config.enrichFields = fields
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, child := range l.children {
+		child.SetEnrichFields(fields...)
+	}
+}
+
+func (l *LoggerZap) enrichEnabled(field string) bool {
+	for _, f := range l.config.enrichFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// staticFields 进程级别的字段，创建 zap logger 时添加
+func (l *LoggerZap) staticFields() []zap.Field {
+	e := env.Instance()
+	if e == nil {
+		return nil
+	}
+	var fields []zap.Field
+	for _, kv := range [][2]string{
+		{FieldService, e.ServiceName},
+		{FieldEnvType, string(e.EnvType)},
+		{FieldEnv, e.Env},
+	} {
+		if kv[1] != "" && l.enrichEnabled(kv[0]) {
+			fields = append(fields, zap.String(kv[0], kv[1]))
+		}
+	}
+	return fields
+}
+
+// ctxFields 请求级别的字段：pmodel.GetCommonHeader 中的用户和设备信息，以及 WithFields 保存的字段
+// exclude 中的 key 已经在本次日志的 kv 中，不再重复添加
+func (l *LoggerZap) ctxFields(ctx context.Context, exclude []interface{}) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields := FieldsFromCtx(ctx)
+	excluded := make(map[string]bool, len(exclude)/2)
+	for i := 0; i+1 < len(exclude); i += 2 {
+		excluded[fieldKey(exclude[i])] = true
+	}
+	var kvs []interface{}
+	if len(l.config.enrichFields) > 0 {
+		// WithFields 中同名的字段优先
+		overridden := make(map[string]bool, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			overridden[fields[i].(string)] = true
+		}
+		h := pmodel.GetCommonHeader(ctx)
+		for _, kv := range [][2]string{
+			{FieldUid, h.Uid},
+			{FieldDeviceId, h.DeviceId},
+			{FieldAppId, h.AppId},
+			{FieldVersionCode, h.VersionCode},
+		} {
+			if kv[1] != "" && !excluded[kv[0]] && !overridden[kv[0]] && l.enrichEnabled(kv[0]) {
+				kvs = append(kvs, kv[0], kv[1])
+			}
+		}
+	}
+	for i := 0; i < len(fields); i += 2 {
+		if k := fields[i].(string); !excluded[k] {
+			kvs = append(kvs, k, fields[i+1])
+		}
+	}
+	return kvs
+}
@@ -1,56 +1,188 @@
 package logs
 
 import (
-	"log"
+	"fmt"
+	"io"
 	"os"
-	"path"
-	"time"
+	"strings"
 
 	"github.com/EICHI-X/ptools/env"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
 
-	"gopkg.in/natefinch/lumberjack.v2"
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
 )
 
-func init() {
+// Config 日志初始化配置，Dir 为空时只输出到 stdout
+type Config struct {
+	Dir         string      // 日志目录，如 ./log/app
+	FilePattern string      // 文件名，按 time.Format 格式化周期开始时间，按小时轮转时需包含小时，如 2006-01-02-15.log；为空时按 Rotate 使用 RotateWriter 的默认格式
+	Rotate      string      // RotateDaily 或 RotateHourly，默认按天在本地零点轮转
+	DirPerm     os.FileMode // 创建目录的权限，默认 0755
+	MaxSizeMB   int         // 单个文件最大 MB，默认 20
+	MaxBackups  int         // 最多保留的旧文件数，0 表示不限制
+	MaxAgeDays  int         // 文件最多保留天数，0 表示不限制
+	MaxTotalMB  int         // 目录下日志文件总大小上限，超出时删除最旧的文件，0 表示不限制
+	Compress    bool        // 轮转后的文件是否 gzip 压缩
+	Format      string      // FormatJSON 或 FormatConsole，默认 json
+	Stdout      bool        // 写文件时是否同时输出到 stdout
+	Level       string      // trace/debug/info/warn/error，为空时 ppe、boe 为 debug，其他为 info
+	Redactor    *Redactor   // 日志打码规则，为空时使用 DefaultRedactor
+	NoRedact    bool        // 关闭打码
+	// EnrichFields 自动添加的字段，为空时使用 DefaultEnrichFields
+	EnrichFields []string
+	NoEnrich     bool // 不自动添加字段，WithFields 保存的字段仍然生效
+	// Sampling 按调用点采样，为空时不采样
+	Sampling *SamplingConfig
+}
 
-	var logFilePath string
-	dir := "./"
-	logFilePath = dir + "/log/app/"
-	if err := os.MkdirAll(logFilePath, 0o777); err != nil {
-		log.Println(err.Error())
+// DefaultConfig 与原来 init 中的配置一致：./log/app/日期.log，20M 轮转，保留 5 个文件 10 天，不采样
+func DefaultConfig() Config {
+	return Config{
+		Dir:        "./log/app",
+		DirPerm:    0o755,
+		MaxSizeMB:  20,
+		MaxBackups: 5,
+		MaxAgeDays: 10,
+		Compress:   true,
+		Format:     FormatJSON,
+	}
+}
 
-		panic(err.Error())
+// defaultLevel 没有配置级别时 ppe、boe 使用 debug
+func defaultLevel() Level {
+	if env.IsPpe() || env.IsBoe() {
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
+// newDefaultLogger 没有调用 Init 时使用的 logger，只输出到 stdout，不创建任何文件
+func newDefaultLogger() *LoggerZap {
+	l := NewLoggerZap(WithZapOptions(zap.AddCaller(), zap.AddCallerSkip(3)))
+	l.SetLevel(defaultLevel())
+	return l
+}
 
+// GetLevel 解析配置的级别，为空时按环境返回默认级别
+func (cfg Config) GetLevel() (Level, error) {
+	if cfg.Level == "" {
+		return defaultLevel(), nil
 	}
+	return ParseLevel(cfg.Level)
+}
 
-	// 将文件名设置为日期
-	logFileName := time.Now().Format("2006-01-02") + ".log"
-	fileName := path.Join(logFilePath, logFileName)
-	if _, err := os.Stat(fileName); err != nil {
-		if _, err := os.Create(fileName); err != nil {
-			log.Println(err.Error())
-			panic(err.Error())
+// Encoder 按 Format 返回 zap 编码器
+func (cfg Config) Encoder() (zapcore.Encoder, error) {
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatJSON:
+		return zapcore.NewJSONEncoder(defaultEncoderConfig()), nil
+	case FormatConsole:
+		return zapcore.NewConsoleEncoder(defaultEncoderConfig()), nil
+	}
+	return nil, fmt.Errorf("log format %v not valid", cfg.Format)
+}
 
-		}
+// GetRedactor 配置的打码规则，关闭时返回 nil
+func (cfg Config) GetRedactor() *Redactor {
+	if cfg.NoRedact {
+		return nil
+	}
+	if cfg.Redactor != nil {
+		return cfg.Redactor
 	}
+	return DefaultRedactor()
+}
 
-	// logger := hertzlogrus.NewLogger()
-	// 提供压缩和删除
-	lumberjackLogger := &lumberjack.Logger{
-		Filename:   fileName,
-		MaxSize:    20,   // 一个文件最大可达 20M。
-		MaxBackups: 5,    // 最多同时保存 5 个文件。
-		MaxAge:     10,   // 一个文件最多可以保存 10 天。
-		Compress:   true, // 用 gzip 压缩。
+// GetEnrichFields 配置的自动添加字段，关闭时返回 nil
+func (cfg Config) GetEnrichFields() []string {
+	if cfg.NoEnrich {
+		return nil
 	}
-	// logger.SetOutput(lumberjackLogger)
-	// logger.SetLevel(hlog.LevelDebug)
-	logger := NewLoggerZap(WithZapOptions(zap.AddCaller(), zap.AddCallerSkip(3)))
-	if env.IsPpe() || env.IsBoe() {
-		logger.SetLevel(LevelDebug)
+	if len(cfg.EnrichFields) > 0 {
+		return cfg.EnrichFields
+	}
+	return DefaultEnrichFields
+}
+
+// GetSampler 按配置创建 Sampler，没有配置时返回 nil
+func (cfg Config) GetSampler() *Sampler {
+	if cfg.Sampling == nil {
+		return nil
+	}
+	return NewSampler(*cfg.Sampling)
+}
+
+// Writer 按配置创建输出，目录无法创建或文件名不随轮转周期变化时返回错误而不是 panic
+func (cfg Config) Writer() (io.Writer, error) {
+	if cfg.Dir == "" {
+		return os.Stdout, nil
+	}
+	perm := cfg.DirPerm
+	if perm == 0 {
+		perm = 0o755
+	}
+	if err := os.MkdirAll(cfg.Dir, perm); err != nil {
+		return nil, fmt.Errorf("create log dir %v fail %w", cfg.Dir, err)
+	}
+	maxSize := cfg.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = 20
+	}
+	switch cfg.Rotate {
+	case "", RotateDaily, RotateHourly:
+	default:
+		return nil, fmt.Errorf("log rotate %v not valid", cfg.Rotate)
+	}
+	// 提供按周期和大小轮转、压缩和删除
+	rw := &RotateWriter{
+		Dir:        cfg.Dir,
+		Pattern:    cfg.FilePattern,
+		Period:     cfg.Rotate,
+		MaxSizeMB:  maxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAgeDays: cfg.MaxAgeDays,
+		MaxTotalMB: cfg.MaxTotalMB,
+		Compress:   cfg.Compress,
+	}
+	if err := rw.checkPattern(); err != nil {
+		return nil, err
+	}
+	var w io.Writer = rw
+	if cfg.Stdout {
+		w = io.MultiWriter(w, os.Stdout)
+	}
+	return w, nil
+}
+
+// Init 按配置初始化默认 logger，需要在 main 中显式调用，不调用时只输出到 stdout
+// 默认 logger 是 LoggerZap 时原地修改，之前通过 Named 创建的子 logger 同样生效
+func Init(cfg Config) error {
+	level, err := cfg.GetLevel()
+	if err != nil {
+		return err
+	}
+	enc, err := cfg.Encoder()
+	if err != nil {
+		return err
+	}
+	w, err := cfg.Writer()
+	if err != nil {
+		return err
+	}
+	l, ok := logger.(*LoggerZap)
+	if !ok {
+		l = newDefaultLogger()
+		SetLogger(l)
 	}
-	logger.SetOutput(lumberjackLogger)
-	// hlog.SetLogger(logger)
-	SetLogger(logger) // option with caller
+	l.SetEncoder(enc)
+	l.SetRedactor(cfg.GetRedactor())
+	l.SetEnrichFields(cfg.GetEnrichFields()...)
+	l.SetSampler(cfg.GetSampler())
+	l.SetOutput(w)
+	l.SetLevel(level)
+	return nil
 }
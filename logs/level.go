@@ -0,0 +1,346 @@
+package logs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultElevateTtl 通过 Apply 或 SIGUSR1 调低到 debug 且没有指定时长时，自动恢复的时间
+const DefaultElevateTtl = 30 * time.Minute
+
+var levelNames = []string{"trace", "debug", "info", "notice", "warn", "error", "fatal"}
+
+func (lv Level) String() string {
+	if lv >= LevelTrace && lv <= LevelFatal {
+		return levelNames[lv]
+	}
+	return fmt.Sprintf("level(%d)", int(lv))
+}
+
+// ParseLevel 解析 trace/debug/info/notice/warn/error/fatal，不区分大小写
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("log level %v not valid", s)
+}
+
+func (l *LoggerZap) newZapLogger() *zap.Logger {
+	core := l.config.redactor.WrapCore(zapcore.NewCore(l.config.coreConfig.enc, l.config.coreConfig.ws, l.levelEnabler()))
+	if s := l.config.sampler; s != nil {
+		if l.parent == nil {
+			s.report.Store(&reportCore{core})
+		}
+		core = s.WrapCore(core)
+	}
+	log := zap.New(core, l.config.zapOpts...)
+	if l.name != "" {
+		log = log.Named(l.name)
+	}
+	if fields := l.staticFields(); len(fields) > 0 {
+		log = log.With(fields...)
+	}
+	return log
+}
+
+// levelEnabler 子 logger 按 inherit 决定使用自己的级别还是父 logger 的级别
+func (l *LoggerZap) levelEnabler() zapcore.LevelEnabler {
+	if l.parent == nil {
+		return l.config.coreConfig.lvl
+	}
+	return zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
+		if l.inherit.Load() {
+			return l.parent.levelEnabler().Enabled(lvl)
+		}
+		return l.config.coreConfig.lvl.Enabled(lvl)
+	})
+}
+
+// Level 当前生效的级别，跟随父 logger 时返回父 logger 的级别
+func (l *LoggerZap) Level() Level {
+	if l.parent != nil && l.inherit.Load() {
+		return l.parent.Level()
+	}
+	lvl := l.config.coreConfig.lvl.Level()
+	// 级别没有被直接修改 AtomicLevel 的方式改掉时返回配置的级别
+	if p := l.level.Load(); p != nil && zapLevel(*p) == lvl {
+		return *p
+	}
+	switch lvl {
+	case zap.DebugLevel:
+		return LevelDebug
+	case zap.InfoLevel:
+		return LevelInfo
+	case zap.WarnLevel:
+		return LevelWarn
+	case zap.ErrorLevel:
+		return LevelError
+	}
+	return LevelFatal
+}
+
+// zapLevel Level 对应的 zap 级别，trace 按 debug，notice 按 warn 输出
+func zapLevel(level Level) zapcore.Level {
+	switch level {
+	case LevelTrace, LevelDebug:
+		return zap.DebugLevel
+	case LevelInfo:
+		return zap.InfoLevel
+	case LevelWarn, LevelNotice:
+		return zap.WarnLevel
+	case LevelError:
+		return zap.ErrorLevel
+	case LevelFatal:
+		return zap.FatalLevel
+	}
+	return zap.WarnLevel
+}
+
+// InheritLevel 子 logger 取消单独设置的级别，重新跟随父 logger
+func (l *LoggerZap) InheritLevel() {
+	if l.parent != nil {
+		l.inherit.Store(true)
+	}
+}
+
+// Named 返回名字为 name 的子 logger，输出与当前 logger 相同，日志带 logger 字段
+// 级别默认跟随父 logger，SetLevel 后单独生效，可用于只打开某个包的 debug 日志
+// 同名只创建一次，子 logger 的 Named 使用 父名字.name
+func (l *LoggerZap) Named(name string) *LoggerZap {
+	if l.parent != nil {
+		return l.parent.Named(l.name + "." + name)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if child, ok := l.children[name]; ok {
+		return child
+	}
+	cfg := *l.config
+	cfg.coreConfig.lvl = zap.NewAtomicLevelAt(l.config.coreConfig.lvl.Level())
+	// 子 logger 直接调用方法，比包级别的 logs.Infof 等函数少一层调用
+	cfg.zapOpts = append(append([]zap.Option{}, l.config.zapOpts...), zap.AddCallerSkip(-1))
+	child := &LoggerZap{config: &cfg, name: name, parent: l}
+	child.inherit.Store(true)
+	child.level.Store(l.level.Load())
+	child.SugaredLogger = child.newZapLogger().Sugar()
+	if l.children == nil {
+		l.children = map[string]*LoggerZap{}
+	}
+	l.children[name] = child
+	return child
+}
+
+// Named 默认 logger 的子 logger，默认 logger 不是 LoggerZap 时直接返回默认 logger
+func Named(name string) FullLogger {
+	if l, ok := logger.(*LoggerZap); ok {
+		return l.Named(name)
+	}
+	return logger
+}
+
+// LoggerLevel 某个 logger 当前的级别
+type LoggerLevel struct {
+	Name     string     `json:"name"` // 为空表示根 logger
+	Level    string     `json:"level"`
+	Inherit  bool       `json:"inherit,omitempty"`   // 是否跟随根 logger
+	RevertAt *time.Time `json:"revert_at,omitempty"` // 临时调整的恢复时间
+}
+
+type levelRevert struct {
+	level   Level
+	inherit bool
+	timer   *time.Timer
+	at      time.Time
+}
+
+// LevelController 运行时修改根 logger 和子 logger 的级别，支持到期自动恢复
+type LevelController struct {
+	Logger *LoggerZap
+	// DefaultTtl Apply 调到 info 以下且没有指定 ttl 时使用，默认 DefaultElevateTtl，避免线上忘记恢复
+	DefaultTtl time.Duration
+
+	mu      sync.Mutex
+	reverts map[string]*levelRevert
+}
+
+func NewLevelController(l *LoggerZap) *LevelController {
+	return &LevelController{Logger: l, DefaultTtl: DefaultElevateTtl, reverts: map[string]*levelRevert{}}
+}
+
+var (
+	defaultLevelController   *LevelController
+	defaultLevelControllerMu sync.Mutex
+)
+
+// DefaultLevelController 默认 logger 的 LevelController，默认 logger 不是 LoggerZap 时返回 nil
+func DefaultLevelController() *LevelController {
+	defaultLevelControllerMu.Lock()
+	defer defaultLevelControllerMu.Unlock()
+	l, ok := logger.(*LoggerZap)
+	if !ok {
+		return nil
+	}
+	if defaultLevelController == nil || defaultLevelController.Logger != l {
+		defaultLevelController = NewLevelController(l)
+	}
+	return defaultLevelController
+}
+
+var ErrLoggerNotFound = errors.New("logger not registered")
+
+// logger 只查找已通过 Named 创建的子 logger，不会新建，避免管理接口传入任意 name 创建 logger
+func (c *LevelController) logger(name string) (*LoggerZap, error) {
+	if name == "" {
+		return c.Logger, nil
+	}
+	root := c.Logger
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	l, ok := root.children[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrLoggerNotFound, name)
+	}
+	return l, nil
+}
+
+// SetLevel 修改 name 对应 logger 的级别，name 为空表示根 logger，name 未注册时返回 ErrLoggerNotFound
+// ttl > 0 时为临时调整，到期后恢复到第一次临时调整之前的级别；再次调整会取消未到期的恢复
+func (c *LevelController) SetLevel(name string, level Level, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.logger(name)
+	if err != nil {
+		return err
+	}
+	r, pending := c.reverts[name]
+	if pending {
+		r.timer.Stop()
+		delete(c.reverts, name)
+	}
+	if ttl > 0 {
+		if !pending {
+			r = &levelRevert{level: l.Level(), inherit: l.parent != nil && l.inherit.Load()}
+		}
+		revert := r
+		revert.at = time.Now().Add(ttl)
+		revert.timer = time.AfterFunc(ttl, func() {
+			c.revert(name, revert)
+		})
+		c.reverts[name] = revert
+	}
+	l.SetLevel(level)
+	return nil
+}
+
+func (c *LevelController) revert(name string, r *levelRevert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reverts[name] != r {
+		return
+	}
+	delete(c.reverts, name)
+	if l, err := c.logger(name); err == nil {
+		c.restore(l, r)
+	}
+}
+
+func (c *LevelController) restore(l *LoggerZap, r *levelRevert) {
+	l.SetLevel(r.level)
+	if r.inherit {
+		l.InheritLevel()
+	}
+}
+
+// Reset 立即结束临时调整，子 logger 重新跟随根 logger，name 未注册时返回 ErrLoggerNotFound
+func (c *LevelController) Reset(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.logger(name)
+	if err != nil {
+		return err
+	}
+	if r, ok := c.reverts[name]; ok {
+		r.timer.Stop()
+		delete(c.reverts, name)
+		c.restore(l, r)
+	}
+	l.InheritLevel()
+	return nil
+}
+
+// Apply 按字符串参数修改级别，供管理接口使用；ttl 为 Go duration 格式，0 表示永久
+// ttl 为空且级别低于 info 时使用 DefaultTtl
+func (c *LevelController) Apply(name string, level string, ttl string) error {
+	lv, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	var d time.Duration
+	if ttl != "" {
+		if d, err = time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("ttl %v not valid", ttl)
+		}
+	} else if lv < LevelInfo {
+		d = c.DefaultTtl
+	}
+	return c.SetLevel(strings.TrimSpace(name), lv, d)
+}
+
+// Levels 根 logger 和所有子 logger 当前的级别
+func (c *LevelController) Levels() []*LoggerLevel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	root := c.Logger
+	root.mu.Lock()
+	names := make([]string, 0, len(root.children))
+	loggers := make(map[string]*LoggerZap, len(root.children)+1)
+	for name, l := range root.children {
+		names = append(names, name)
+		loggers[name] = l
+	}
+	root.mu.Unlock()
+	sort.Strings(names)
+	loggers[""] = root
+
+	res := make([]*LoggerLevel, 0, len(names)+1)
+	for _, name := range append([]string{""}, names...) {
+		l := loggers[name]
+		item := &LoggerLevel{Name: name, Level: l.Level().String(), Inherit: l.parent != nil && l.inherit.Load()}
+		if r, ok := c.reverts[name]; ok {
+			at := r.at
+			item.RevertAt = &at
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+// ToggleDebug 根 logger 有未到期的临时调整时立即恢复，否则临时调到 debug，用于 SIGUSR1
+func (c *LevelController) ToggleDebug(ttl time.Duration) {
+	c.mu.Lock()
+	_, pending := c.reverts[""]
+	c.mu.Unlock()
+	if pending {
+		_ = c.Reset("")
+		c.Logger.Infof("log level reverted to %v", c.Logger.Level())
+		return
+	}
+	if ttl <= 0 {
+		ttl = c.DefaultTtl
+	}
+	_ = c.SetLevel("", LevelDebug, ttl)
+	c.Logger.Infof("log level set to debug for %v", ttl)
+}
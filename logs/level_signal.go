@@ -0,0 +1,29 @@
+//go:build !windows
+
+package logs
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// WatchSignal 收到 SIGUSR1 时切换根 logger 的 debug 级别，ttl 后自动恢复，见 ToggleDebug
+// 例如 kill -USR1 <pid> 打开 debug，再发送一次立即恢复
+func (c *LevelController) WatchSignal(ctx context.Context, ttl time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				c.ToggleDebug(ttl)
+			}
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package logs
+
+import (
+	"context"
+	"time"
+)
+
+// WatchSignal windows 没有 SIGUSR1，不做任何处理
+func (c *LevelController) WatchSignal(ctx context.Context, ttl time.Duration) {}
@@ -0,0 +1,26 @@
+package logs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelRoundTrip(t *testing.T) {
+	l := NewLoggerZap()
+	for _, lv := range []Level{LevelTrace, LevelDebug, LevelInfo, LevelNotice, LevelWarn, LevelError, LevelFatal} {
+		l.SetLevel(lv)
+		assert.Equal(t, lv, l.Level())
+	}
+
+	child := l.Named("level_test")
+	l.SetLevel(LevelTrace)
+	assert.Equal(t, LevelTrace, child.Level())
+
+	c := NewLevelController(l)
+	assert.NoError(t, c.SetLevel("", LevelError, time.Hour))
+	assert.Equal(t, LevelError, l.Level())
+	assert.NoError(t, c.Reset(""))
+	assert.Equal(t, LevelTrace, l.Level())
+}
@@ -19,6 +19,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
 
 	"go.opentelemetry.io/otel/attribute"
@@ -47,9 +49,17 @@ var (
 type LoggerZap struct {
 	*zap.SugaredLogger
 	config *config
+
+	name     string
+	parent   *LoggerZap
+	inherit  atomic.Bool // 子 logger 没有单独设置级别时跟随父 logger
+	level    atomic.Pointer[Level] // SetLevel 设置的级别，zap 级别无法区分 trace/debug、notice/warn
+	mu       sync.Mutex
+	children map[string]*LoggerZap
 }
 
-var logger FullLogger 
+// logger 默认只输出到 stdout，调用 Init 后按配置输出
+var logger FullLogger = newDefaultLogger()
 
 // SetOutput sets the output of default logger. By default, it is stderr.
 func SetOutput(w io.Writer) {
@@ -85,14 +95,9 @@ func NewLoggerZap(opts ...Option) *LoggerZap {
 		opt.apply(config)
 	}
 
-	logger := zap.New(
-		zapcore.NewCore(config.coreConfig.enc, config.coreConfig.ws, config.coreConfig.lvl),
-		config.zapOpts...)
-
-	return &LoggerZap{
-		SugaredLogger: logger.Sugar(),
-		config:        config,
-	}
+	l := &LoggerZap{config: config}
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	return l
 }
 
 func (l *LoggerZap) Log(level Level, kvs ...interface{}) {
@@ -146,6 +151,7 @@ func (l *LoggerZap) CtxLogf(level Level, ctx context.Context, format string, kvs
 	if span.SpanContext().TraceFlags().IsSampled() {
 		traceKVs = append(traceKVs, traceFlagsKey, span.SpanContext().TraceFlags())
 	}
+	traceKVs = append(traceKVs, l.ctxFields(ctx, nil)...)
 	if len(traceKVs) > 0 {
 		sl = l.With(traceKVs...)
 	} else {
@@ -177,7 +183,7 @@ func (l *LoggerZap) CtxLogf(level Level, ctx context.Context, format string, kvs
 		return
 	}
 
-	msg := getMessage(format, kvs)
+	msg := l.config.redactor.Redact(getMessage(format, kvs))
 
 	attrs := []attribute.KeyValue{
 		logMessageKey.String(msg),
@@ -283,32 +289,33 @@ func (l *LoggerZap) CtxFatalf(ctx context.Context, format string, v ...interface
 }
 
 func (l *LoggerZap) SetLevel(level Level) {
-	var lvl zapcore.Level
-	switch level {
-	case LevelTrace, LevelDebug:
-		lvl = zap.DebugLevel
-	case LevelInfo:
-		lvl = zap.InfoLevel
-	case LevelWarn, LevelNotice:
-		lvl = zap.WarnLevel
-	case LevelError:
-		lvl = zap.ErrorLevel
-	case LevelFatal:
-		lvl = zap.FatalLevel
-	default:
-		lvl = zap.WarnLevel
-	}
+	l.level.Store(&level)
+	lvl := zapLevel(level)
 	l.config.coreConfig.lvl.SetLevel(lvl)
+	l.inherit.Store(false)
 }
 
+// SetEncoder 修改日志格式，同时修改所有子 logger
+func (l *LoggerZap) SetEncoder(enc zapcore.Encoder) {
+	l.config.coreConfig.enc = enc
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, child := range l.children {
+		child.SetEncoder(enc)
+	}
+}
+
+// SetOutput 同时修改所有子 logger 的输出
 func (l *LoggerZap) SetOutput(writer io.Writer) {
 	ws := zapcore.AddSync(writer)
-	log := zap.New(
-		zapcore.NewCore(l.config.coreConfig.enc, ws, l.config.coreConfig.lvl),
-		l.config.zapOpts...,
-	)
 	l.config.coreConfig.ws = ws
-	l.SugaredLogger = log.Sugar()
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, child := range l.children {
+		child.SetOutput(writer)
+	}
 }
 
 func (l *LoggerZap) CtxKVLog(ctx context.Context, level Level, format string, kvs ...interface{}) {
@@ -317,6 +324,7 @@ func (l *LoggerZap) CtxKVLog(ctx context.Context, level Level, format string, kv
 		return
 	}
 
+	kvs = append(kvs, l.ctxFields(ctx, kvs)...)
 	span := trace.SpanFromContext(ctx)
 	if span.SpanContext().TraceID().IsValid() {
 		kvs = append(kvs, traceIDKey, span.SpanContext().TraceID())
@@ -355,7 +363,7 @@ func (l *LoggerZap) CtxKVLog(ctx context.Context, level Level, format string, kv
 		return
 	}
 
-	msg := getMessage(format, kvs)
+	msg := l.config.redactor.Redact(getMessage(format, kvs))
 	attrs := []attribute.KeyValue{
 		logMessageKey.String(msg),
 		logSeverityTextKey.String(OtelSeverityText(zlevel)),
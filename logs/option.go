@@ -46,19 +46,27 @@ type config struct {
 	coreConfig  coreConfig
 	zapOpts     []zap.Option
 	traceConfig *traceConfig
+	redactor    *Redactor
+	// enrichFields 自动添加的字段
+	enrichFields []string
+	sampler      *Sampler
 }
 
-// defaultCoreConfig default zapcore config: json encoder, atomic level, stdout write syncer
-func defaultCoreConfig() *coreConfig {
-	// default log encoder
+// defaultEncoderConfig default encoder config shared by json and console encoder
+func defaultEncoderConfig() zapcore.EncoderConfig {
 	con := zap.NewProductionEncoderConfig()
 	con.CallerKey = "line"
 	con.FunctionKey = "func"
-	con.EncodeLevel =  zapcore.CapitalLevelEncoder
-	con.EncodeLevel =  zapcore.CapitalLevelEncoder
+	con.EncodeLevel = zapcore.CapitalLevelEncoder
 	con.EncodeName = zapcore.FullNameEncoder
 	con.EncodeTime = zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05")
-	enc := zapcore.NewJSONEncoder(con)
+	return con
+}
+
+// defaultCoreConfig default zapcore config: json encoder, atomic level, stdout write syncer
+func defaultCoreConfig() *coreConfig {
+	// default log encoder
+	enc := zapcore.NewJSONEncoder(defaultEncoderConfig())
 	// default log level
 	lvl := zap.NewAtomicLevelAt(zap.InfoLevel)
 	// default write syncer stdout
@@ -95,7 +103,9 @@ func defaultConfig() *config {
 			recordStackTraceInSpan: true,
 			errorSpanLevel:         zapcore.ErrorLevel,
 		},
-		zapOpts: []zap.Option{},
+		zapOpts:      []zap.Option{},
+		redactor:     DefaultRedactor(),
+		enrichFields: DefaultEnrichFields,
 	}
 }
 
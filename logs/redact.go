@@ -0,0 +1,384 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const defaultRedactMask = "******"
+
+// DefaultRedactKeys 字段名或消息中 key=value、key: value、"key":"value" 的 key 以这些词结尾时整体打码
+// key 按 _、- 和驼峰拆分后比较，忽略大小写和复数，如 access_token、accesstoken、Authorization、idCard、cookies 都会命中
+// has_token、is_token、max_tokens、TokenCount 等只描述数量或状态的 key 不会命中，见 nonSensitivePrefixes
+var DefaultRedactKeys = []string{
+	"token", "password", "passwd", "pwd", "secret", "authorization", "cookie", "idcard", "idno", "bankcard", "cardno",
+}
+
+// RedactRule 按正则打码，Mask 为空时整体替换为 Redactor.Mask
+type RedactRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Mask    func(match string) string
+}
+
+var (
+	jwtRegexp    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`)
+	bearerRegexp = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`)
+	digitsRegexp = regexp.MustCompile(`\d{11,}[Xx]?`)
+)
+
+// JwtRule 打码 JWT，保留 eyJ 前缀便于排查
+func JwtRule() RedactRule {
+	return RedactRule{Name: "jwt", Pattern: jwtRegexp, Mask: func(string) string { return "eyJ" + defaultRedactMask }}
+}
+
+// BearerRule 打码 Authorization 头中的 Bearer token
+func BearerRule() RedactRule {
+	return RedactRule{Name: "bearer", Pattern: bearerRegexp, Mask: func(string) string { return "Bearer " + defaultRedactMask }}
+}
+
+// DigitsRule 打码连续数字中的手机号、身份证号和银行卡号
+// 只处理完整的数字串，身份证号校验出生日期，银行卡号校验 Luhn，避免误伤订单号、时间戳等普通 id
+func DigitsRule() RedactRule {
+	return RedactRule{Name: "digits", Pattern: digitsRegexp, Mask: maskDigits}
+}
+
+func maskDigits(s string) string {
+	switch {
+	case isMobile(s):
+		return s[:3] + "****" + s[7:]
+	case len(s) == 13 && strings.HasPrefix(s, "86") && isMobile(s[2:]):
+		return s[:5] + "****" + s[9:]
+	case isIdCard(s):
+		return s[:3] + strings.Repeat("*", 11) + s[14:]
+	case isBankCard(s):
+		return s[:4] + strings.Repeat("*", len(s)-8) + s[len(s)-4:]
+	}
+	return s
+}
+
+func isMobile(s string) bool {
+	return len(s) == 11 && s[0] == '1' && s[1] >= '3' && s[1] <= '9'
+}
+
+func isIdCard(s string) bool {
+	if len(s) != 18 || s[0] == '0' {
+		return false
+	}
+	year, month, day := s[6:10], s[10:12], s[12:14]
+	return (year[:2] == "19" || year[:2] == "20") &&
+		month >= "01" && month <= "12" &&
+		day >= "01" && day <= "31"
+}
+
+func isBankCard(s string) bool {
+	if len(s) < 16 || len(s) > 19 || s[0] < '3' || s[0] > '6' {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(s); i++ {
+		c := s[len(s)-1-i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		n := int(c - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// Redactor 打码日志中的敏感信息，作用于消息和 KV 字段，使用 NewRedactor 创建
+// 字段名命中 Keys 时整个值打码；其余字符串值、消息以及 map/struct 序列化后的 JSON 按 Rules 打码
+// zapcore.ObjectMarshaler、ArrayMarshaler 类型的字段不处理
+type Redactor struct {
+	Keys  []string
+	Rules []RedactRule
+	Mask  string // 默认 ******
+
+	kvRegexp *regexp.Regexp
+}
+
+func NewRedactor(keys []string, rules ...RedactRule) *Redactor {
+	r := &Redactor{Keys: keys, Rules: rules, Mask: defaultRedactMask}
+	quoted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		// 消息中的 key 可能带 _ 或 -，如 id_card、access-token
+		chars := make([]string, 0, len(k))
+		for _, c := range normalizeKey(k) {
+			chars = append(chars, regexp.QuoteMeta(string(c)))
+		}
+		if len(chars) > 0 {
+			quoted = append(quoted, strings.Join(chars, "[_-]?"))
+		}
+	}
+	if len(quoted) > 0 {
+		// 值可能带 Bearer 前缀，用引号包裹或到分隔符为止
+		r.kvRegexp = regexp.MustCompile(`(?i)("?([\w-]*(?:` + strings.Join(quoted, "|") + `)[\w-]*)"?\s*[:=]\s*)("[^"]*"|(?:bearer\s+)?[^\s,;&}\]"]+)`)
+	}
+	return r
+}
+
+// DefaultRedactor 按 DefaultRedactKeys 以及 JWT、Bearer、手机号、身份证号、银行卡号打码
+func DefaultRedactor() *Redactor {
+	return NewRedactor(DefaultRedactKeys, JwtRule(), BearerRule(), DigitsRule())
+}
+
+func normalizeKey(k string) string {
+	k = strings.ToLower(k)
+	return strings.NewReplacer("_", "", "-", "").Replace(k)
+}
+
+var (
+	// nonSensitivePrefixes 以这些词开头的 key 只表示状态或数量，如 has_token、max_tokens
+	nonSensitivePrefixes = []string{"has", "is", "max", "min", "num"}
+	// nonSensitiveSuffixes 以这些词结尾的 key 只表示数量或类型，如 TokenCount、password_len
+	nonSensitiveSuffixes = []string{"count", "num", "len", "length", "size", "limit", "type"}
+)
+
+// keySegments 按 _、-、空格等分隔符和驼峰拆分 key 并转为小写，如 X-AuthToken => x auth token
+func keySegments(key string) []string {
+	var segs []string
+	var cur []rune
+	runes := []rune(key)
+	flush := func() {
+		if len(cur) > 0 {
+			segs = append(segs, strings.ToLower(string(cur)))
+			cur = cur[:0]
+		}
+	}
+	for i, c := range runes {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			flush()
+			continue
+		}
+		// aB 或 ABc 中的 B 开始新的一段
+		if unicode.IsUpper(c) && len(cur) > 0 {
+			prev := cur[len(cur)-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				flush()
+			}
+		}
+		cur = append(cur, c)
+	}
+	flush()
+	return segs
+}
+
+// IsSensitiveKey key 拆分后某一段以 Keys 中的词结尾，或相邻几段拼起来等于 Keys 中的词
+func (r *Redactor) IsSensitiveKey(key string) bool {
+	segs := keySegments(key)
+	if len(segs) == 0 || containsStr(nonSensitivePrefixes, segs[0]) {
+		return false
+	}
+	if len(segs) > 1 && containsStr(nonSensitiveSuffixes, segs[len(segs)-1]) {
+		return false
+	}
+	for _, k := range r.Keys {
+		k = normalizeKey(k)
+		if k == "" {
+			continue
+		}
+		for j, seg := range segs {
+			if strings.HasSuffix(seg, k) || strings.HasSuffix(seg, k+"s") {
+				return true
+			}
+			joined := seg
+			for i := j - 1; i >= 0 && len(joined) < len(k); i-- {
+				joined = segs[i] + joined
+				if joined == k || joined == k+"s" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func containsStr(list []string, v string) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) mask() string {
+	if r.Mask == "" {
+		return defaultRedactMask
+	}
+	return r.Mask
+}
+
+// Redact 打码一段文本，如格式化后的日志消息
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	if r.kvRegexp != nil {
+		s = r.kvRegexp.ReplaceAllStringFunc(s, func(m string) string {
+			sub := r.kvRegexp.FindStringSubmatch(m)
+			if !r.IsSensitiveKey(sub[2]) {
+				return m
+			}
+			if strings.HasPrefix(sub[3], `"`) {
+				return sub[1] + `"` + r.mask() + `"`
+			}
+			return sub[1] + r.mask()
+		})
+	}
+	for _, rule := range r.Rules {
+		if rule.Pattern == nil {
+			continue
+		}
+		mask := rule.Mask
+		if mask == nil {
+			mask = func(string) string { return r.mask() }
+		}
+		s = rule.Pattern.ReplaceAllStringFunc(s, mask)
+	}
+	return s
+}
+
+// Field 打码一个 zap 字段
+func (r *Redactor) Field(f zapcore.Field) zapcore.Field {
+	if r == nil || f.Key == "" || f.Key == traceIDKey || f.Key == spanIDKey {
+		return f
+	}
+	if r.IsSensitiveKey(f.Key) {
+		return zap.String(f.Key, r.mask())
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = r.Redact(f.String)
+	case zapcore.ByteStringType:
+		if b, ok := f.Interface.([]byte); ok {
+			return zap.ByteString(f.Key, []byte(r.Redact(string(b))))
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok {
+			return zap.String(f.Key, r.Redact(s.String()))
+		}
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok && err != nil {
+			return zap.String(f.Key, r.Redact(err.Error()))
+		}
+	case zapcore.ReflectType:
+		return r.reflectField(f)
+	}
+	return f
+}
+
+// reflectField map、struct 等值先序列化为 JSON，按字段名和规则打码后原样输出 JSON
+func (r *Redactor) reflectField(f zapcore.Field) zapcore.Field {
+	b, err := json.Marshal(f.Interface)
+	if err != nil {
+		return f
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return f
+	}
+	res, err := json.Marshal(r.value(v))
+	if err != nil {
+		return f
+	}
+	return zap.Any(f.Key, json.RawMessage(res))
+}
+
+func (r *Redactor) value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if r.IsSensitiveKey(k) {
+				val[k] = r.mask()
+			} else {
+				val[k] = r.value(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = r.value(item)
+		}
+	case string:
+		return r.Redact(val)
+	case json.Number:
+		// 手机号等以数字类型保存时，打码后改为字符串输出
+		if s := r.Redact(val.String()); s != val.String() {
+			return s
+		}
+	}
+	return v
+}
+
+func (r *Redactor) Fields(fields []zapcore.Field) []zapcore.Field {
+	if r == nil || len(fields) == 0 {
+		return fields
+	}
+	res := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		res[i] = r.Field(f)
+	}
+	return res
+}
+
+// WrapCore 返回打码的 zapcore.Core，可用于 zap.WrapCore
+func (r *Redactor) WrapCore(core zapcore.Core) zapcore.Core {
+	if r == nil {
+		return core
+	}
+	return &redactCore{Core: core, r: r}
+}
+
+type redactCore struct {
+	zapcore.Core
+	r *Redactor
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.r.Fields(fields)), r: c.r}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.r.Redact(ent.Message)
+	return c.Core.Write(ent, c.r.Fields(fields))
+}
+
+// WithRedactor 日志打码，默认 DefaultRedactor，传 nil 关闭
+func WithRedactor(r *Redactor) Option {
+	return option(func(cfg *config) {
+		cfg.redactor = r
+	})
+}
+
+// SetRedactor 修改打码规则，nil 表示关闭，同时修改所有子 logger
+func (l *LoggerZap) SetRedactor(r *Redactor) {
+	l.config.redactor = r
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, child := range l.children {
+		child.SetRedactor(r)
+	}
+}
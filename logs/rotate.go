@@ -0,0 +1,374 @@
+package logs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RotateDaily  = "daily"
+	RotateHourly = "hourly"
+
+	compressSuffix = ".gz"
+)
+
+// RotateWriter 按天或小时以及大小轮转的日志文件，实现 zapcore.WriteSyncer，可直接传给 LoggerZap.SetOutput
+// 文件名为 Pattern 按周期开始时间格式化，同一周期内按大小轮转时在扩展名前加序号：2026-10-19.log、2026-10-19.1.log
+// 轮转后在后台压缩旧文件，并按保留天数、文件数和总大小删除最旧的文件
+type RotateWriter struct {
+	Dir        string
+	Pattern    string // time.Format 格式的文件名，默认 daily 为 2006-01-02.log，hourly 为 2006-01-02-15.log，hourly 时必须包含小时
+	Period     string // RotateDaily 或 RotateHourly，默认 daily，在 Location 的零点或整点轮转
+	MaxSizeMB  int    // 单个文件最大 MB，0 表示不按大小轮转
+	MaxAgeDays int    // 旧文件保留天数，0 表示不限制
+	MaxBackups int    // 旧文件最多保留个数，0 表示不限制
+	MaxTotalMB int    // 所有日志文件（包括当前文件）的总大小上限，0 表示不限制
+	Compress   bool   // 是否 gzip 压缩旧文件
+	Location   *time.Location
+	Now        func() time.Time // 测试时替换
+
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+	size     int64
+	periodAt time.Time // 当前周期的开始时间
+	nextAt   time.Time // 下一个周期的开始时间
+	millCh   chan struct{}
+	millOnce sync.Once
+}
+
+func (w *RotateWriter) now() time.Time {
+	t := time.Now()
+	if w.Now != nil {
+		t = w.Now()
+	}
+	if w.Location != nil {
+		return t.In(w.Location)
+	}
+	return t.Local()
+}
+
+func (w *RotateWriter) pattern() string {
+	if w.Pattern != "" {
+		return w.Pattern
+	}
+	if w.Period == RotateHourly {
+		return "2006-01-02-15.log"
+	}
+	return "2006-01-02.log"
+}
+
+// checkPattern 文件名需要随周期变化，否则按小时轮转时同一天的文件会写到一起
+func (w *RotateWriter) checkPattern() error {
+	p := w.pattern()
+	if filepath.Base(p) != p {
+		return fmt.Errorf("log pattern %v should not contain dir", p)
+	}
+	start, next := w.periodStart(time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC))
+	if start.Format(p) == next.Format(p) {
+		return fmt.Errorf("log pattern %v not change with %v rotate", p, w.Period)
+	}
+	return nil
+}
+
+// periodStart t 所在周期的开始时间，按本地时间计算，夏令时也是当天零点
+func (w *RotateWriter) periodStart(t time.Time) (time.Time, time.Time) {
+	if w.Period == RotateHourly {
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		return start, start.Add(time.Hour)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return start, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+}
+
+// seqName 第 seq 个文件的文件名，0 时不带序号
+func seqName(name string, seq int) string {
+	if seq == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + strconv.Itoa(seq) + ext
+}
+
+func (w *RotateWriter) maxSize() int64 {
+	return int64(w.MaxSizeMB) * 1024 * 1024
+}
+
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	if w.file == nil || !now.Before(w.nextAt) {
+		if err := w.openPeriod(now); err != nil {
+			return 0, err
+		}
+	} else if max := w.maxSize(); max > 0 && w.size > 0 && w.size+int64(len(p)) > max {
+		if err := w.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// openPeriod 打开 now 所在周期最新的文件，重启后继续写入未写满的文件
+func (w *RotateWriter) openPeriod(now time.Time) error {
+	if err := w.checkPattern(); err != nil {
+		return err
+	}
+	w.periodAt, w.nextAt = w.periodStart(now)
+	base := w.periodAt.Format(w.pattern())
+	seq := 0
+	for {
+		if _, err := os.Stat(filepath.Join(w.Dir, seqName(base, seq+1))); err == nil {
+			seq++
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(w.Dir, seqName(base, seq+1)+compressSuffix)); err == nil {
+			seq++
+			continue
+		}
+		break
+	}
+	name := filepath.Join(w.Dir, seqName(base, seq))
+	// 最新的文件已经压缩或写满时写下一个序号，不能再写入已压缩的文件名，否则压缩时会覆盖
+	if _, err := os.Stat(name + compressSuffix); err == nil {
+		name = filepath.Join(w.Dir, seqName(base, seq+1))
+	} else if info, err := os.Stat(name); err == nil && w.maxSize() > 0 && info.Size() >= w.maxSize() {
+		name = filepath.Join(w.Dir, seqName(base, seq+1))
+	}
+	return w.openFile(name)
+}
+
+// openNext 同一周期内按大小轮转到下一个序号
+func (w *RotateWriter) openNext() error {
+	base := w.periodAt.Format(w.pattern())
+	for seq := 1; ; seq++ {
+		name := filepath.Join(w.Dir, seqName(base, seq))
+		if _, err := os.Stat(name); err == nil {
+			continue
+		}
+		if _, err := os.Stat(name + compressSuffix); err == nil {
+			continue
+		}
+		return w.openFile(name)
+	}
+}
+
+func (w *RotateWriter) openFile(name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return fmt.Errorf("create log dir fail %w", err)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file fail %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rotated := w.file != nil
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.filename, w.size = f, name, info.Size()
+	if rotated {
+		w.startMill()
+	}
+	return nil
+}
+
+func (w *RotateWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Rotate 立即轮转到新文件
+func (w *RotateWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return w.openPeriod(w.now())
+	}
+	return w.openNext()
+}
+
+// startMill 通知后台压缩和清理，后台正在处理时合并为一次
+func (w *RotateWriter) startMill() {
+	w.millOnce.Do(func() {
+		w.millCh = make(chan struct{}, 1)
+		go func() {
+			for range w.millCh {
+				if err := w.mill(); err != nil {
+					fmt.Fprintf(os.Stderr, "RotateWriter mill fail %v\n", err)
+				}
+			}
+		}()
+	})
+	select {
+	case w.millCh <- struct{}{}:
+	default:
+	}
+}
+
+type logFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// ownFile name 是否是按 pattern 生成的文件，包括序号和压缩后的文件，Dir 下的其他文件不参与清理
+func (w *RotateWriter) ownFile(name string) bool {
+	p := w.pattern()
+	name = strings.TrimSuffix(name, compressSuffix)
+	if _, err := time.Parse(p, name); err == nil {
+		return true
+	}
+	ext := filepath.Ext(p)
+	if !strings.HasSuffix(name, ext) {
+		return false
+	}
+	base := strings.TrimSuffix(name, ext)
+	i := strings.LastIndex(base, ".")
+	if i < 0 {
+		return false
+	}
+	if seq, err := strconv.Atoi(base[i+1:]); err != nil || seq <= 0 {
+		return false
+	}
+	_, err := time.Parse(p, base[:i]+ext)
+	return err == nil
+}
+
+// oldFiles 目录下除当前文件外由 pattern 生成的日志文件，按修改时间从新到旧排序
+func (w *RotateWriter) oldFiles() ([]*logFile, string, error) {
+	w.mu.Lock()
+	current := w.filename
+	w.mu.Unlock()
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return nil, current, err
+	}
+	res := make([]*logFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !w.ownFile(e.Name()) {
+			continue
+		}
+		p := filepath.Join(w.Dir, e.Name())
+		if p == current {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, &logFile{path: p, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].modTime.After(res[j].modTime)
+	})
+	return res, current, nil
+}
+
+// mill 先压缩再按数量、天数和总大小删除，只处理 oldFiles 中 pattern 生成的文件
+func (w *RotateWriter) mill() error {
+	files, current, err := w.oldFiles()
+	if err != nil {
+		return err
+	}
+	if w.Compress {
+		for _, f := range files {
+			if strings.HasSuffix(f.path, compressSuffix) {
+				continue
+			}
+			if err := compressLogFile(f.path); err != nil {
+				return err
+			}
+			f.path += compressSuffix
+			if info, err := os.Stat(f.path); err == nil {
+				f.size = info.Size()
+			}
+		}
+	}
+
+	var total int64
+	if info, err := os.Stat(current); err == nil {
+		total = info.Size()
+	}
+	cutoff := w.now().AddDate(0, 0, -w.MaxAgeDays)
+	maxTotal := int64(w.MaxTotalMB) * 1024 * 1024
+	for i, f := range files {
+		total += f.size
+		remove := (w.MaxBackups > 0 && i >= w.MaxBackups) ||
+			(w.MaxAgeDays > 0 && f.modTime.Before(cutoff)) ||
+			(maxTotal > 0 && total > maxTotal)
+		if !remove {
+			continue
+		}
+		total -= f.size
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressLogFile 先写入临时文件再改名，压缩中途退出不会留下不完整的 .gz
+func compressLogFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := name + compressSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name+compressSuffix); err != nil {
+		return err
+	}
+	// 保留原文件的修改时间，按天数清理时以日志最后写入时间为准
+	os.Chtimes(name+compressSuffix, info.ModTime(), info.ModTime())
+	return os.Remove(name)
+}
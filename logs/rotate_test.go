@@ -0,0 +1,179 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateWriterCheckPattern(t *testing.T) {
+	assert.NoError(t, (&RotateWriter{}).checkPattern())
+	assert.NoError(t, (&RotateWriter{Period: RotateHourly}).checkPattern())
+	assert.Error(t, (&RotateWriter{Period: RotateHourly, Pattern: "2006-01-02.log"}).checkPattern())
+	assert.Error(t, (&RotateWriter{Pattern: "app.log"}).checkPattern())
+}
+
+func TestRotateWriterOwnFile(t *testing.T) {
+	w := &RotateWriter{}
+	for _, name := range []string{"2026-10-19.log", "2026-10-19.3.log", "2026-10-19.log.gz", "2026-10-19.12.log.gz"} {
+		assert.True(t, w.ownFile(name), name)
+	}
+	for _, name := range []string{"access.log", "2026-10-19.x.log", "2026-10-19.0.log", "2026-10-19.txt", "2026-10-19-15.log"} {
+		assert.False(t, w.ownFile(name), name)
+	}
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func logFileNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readLogFile(t *testing.T, dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestRotateWriterPeriod(t *testing.T) {
+	cases := []struct {
+		period string
+		from   time.Time
+		files  []string
+	}{
+		{RotateDaily, time.Date(2026, 10, 19, 23, 59, 59, 0, time.UTC), []string{"2026-10-19.log", "2026-10-20.log"}},
+		{RotateHourly, time.Date(2026, 10, 19, 10, 59, 59, 0, time.UTC), []string{"2026-10-19-10.log", "2026-10-19-11.log"}},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		clock := &fakeClock{t: c.from}
+		w := &RotateWriter{Dir: dir, Period: c.period, Location: time.UTC, Now: clock.now}
+		_, err := w.Write([]byte("a"))
+		assert.NoError(t, err)
+		clock.t = c.from.Add(500 * time.Millisecond)
+		_, err = w.Write([]byte("b"))
+		assert.NoError(t, err)
+		clock.t = c.from.Add(time.Second)
+		_, err = w.Write([]byte("c"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		assert.Equal(t, c.files, logFileNames(t, dir), c.period)
+		assert.Equal(t, "ab", readLogFile(t, dir, c.files[0]))
+		assert.Equal(t, "c", readLogFile(t, dir, c.files[1]))
+	}
+}
+
+func TestRotateWriterSize(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{t: time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)}
+	newWriter := func() *RotateWriter {
+		return &RotateWriter{Dir: dir, MaxSizeMB: 1, Location: time.UTC, Now: clock.now}
+	}
+	chunk := bytes.Repeat([]byte("x"), 600*1024)
+
+	w := newWriter()
+	for i := 0; i < 3; i++ {
+		_, err := w.Write(chunk)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"2026-10-19.1.log", "2026-10-19.2.log", "2026-10-19.log"}, logFileNames(t, dir))
+
+	// 重启后继续写最新的未写满的文件
+	w = newWriter()
+	_, err := w.Write([]byte("y"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "2026-10-19.2.log"), w.filename)
+	// 写满后轮转到下一个序号
+	_, err = w.Write(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "2026-10-19.3.log"), w.filename)
+	assert.NoError(t, w.Close())
+
+	// 最新的文件已经写满或被压缩时从下一个序号开始
+	assert.NoError(t, os.Rename(filepath.Join(dir, "2026-10-19.3.log"), filepath.Join(dir, "2026-10-19.3.log.gz")))
+	w = newWriter()
+	_, err = w.Write([]byte("z"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "2026-10-19.4.log"), w.filename)
+	assert.NoError(t, w.Close())
+}
+
+// writeOldLog 在 dir 下写入修改时间为 mod 的文件
+func writeOldLog(t *testing.T, dir string, name string, size int, mod time.Time) {
+	p := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(p, bytes.Repeat([]byte("o"), size), 0o644))
+	assert.NoError(t, os.Chtimes(p, mod, mod))
+}
+
+func TestRotateWriterCompress(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	w := &RotateWriter{Dir: dir, Compress: true, Location: time.UTC, Now: func() time.Time { return now }}
+	_, err := w.Write([]byte("current"))
+	assert.NoError(t, err)
+	defer w.Close()
+	writeOldLog(t, dir, "2026-10-18.log", 100, now.Add(-8*time.Hour))
+	writeOldLog(t, dir, "access.log", 100, now.Add(-8*time.Hour))
+
+	assert.NoError(t, w.mill())
+	assert.Equal(t, []string{"2026-10-18.log.gz", "2026-10-19.log", "access.log"}, logFileNames(t, dir))
+
+	f, err := os.Open(filepath.Join(dir, "2026-10-18.log.gz"))
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("o"), 100), data)
+	info, err := f.Stat()
+	assert.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(now.Add(-8*time.Hour)))
+}
+
+func TestRotateWriterRetention(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		w     *RotateWriter
+		files []string
+	}{
+		{"backups", &RotateWriter{MaxBackups: 1}, []string{"2026-10-18.log", "2026-10-19.log", "access.log"}},
+		{"age", &RotateWriter{MaxAgeDays: 3}, []string{"2026-10-16.log", "2026-10-17.log", "2026-10-18.log", "2026-10-19.log", "access.log"}},
+		{"total", &RotateWriter{MaxTotalMB: 1}, []string{"2026-10-17.log", "2026-10-18.log", "2026-10-19.log", "access.log"}},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		w := c.w
+		w.Dir, w.Location, w.Now = dir, time.UTC, func() time.Time { return now }
+		_, err := w.Write([]byte("current"))
+		assert.NoError(t, err)
+		for i := 1; i <= 4; i++ {
+			day := now.AddDate(0, 0, -i)
+			writeOldLog(t, dir, day.Format("2006-01-02.log"), 400*1024, day.Add(23*time.Hour))
+		}
+		writeOldLog(t, dir, "access.log", 100, now.AddDate(0, 0, -30))
+
+		assert.NoError(t, w.mill(), c.name)
+		assert.Equal(t, c.files, logFileNames(t, dir), c.name)
+		assert.NoError(t, w.Close())
+	}
+}
@@ -0,0 +1,236 @@
+package logs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const maxSampleSites = 4096
+
+// SamplingConfig 按调用点采样，每个调用点每个 Tick 内前 First 条全部输出，之后每 Thereafter 条输出 1 条
+// Error 及以上级别不采样
+type SamplingConfig struct {
+	Tick           time.Duration // 默认 1s
+	First          int           // 默认 100
+	Thereafter     int           // 0 表示超过 First 后全部丢弃
+	ReportInterval time.Duration // 输出被丢弃条数的间隔，默认 1min
+}
+
+type sampleSite struct {
+	caller     string
+	msg        atomic.Value // 第一条日志的消息，用于统计输出
+	level      zapcore.Level
+	resetAt    atomic.Int64
+	count      atomic.Int64
+	suppressed atomic.Int64
+}
+
+// Sampler 按调用点采样，调用点取 zap 的 caller，需要 zap.AddCaller，没有 caller 的日志不采样
+// 被丢弃的条数每隔 ReportInterval 以一条 warn 日志输出，同时清理一个 ReportInterval 内没有日志的调用点
+// Named 创建的子 logger 共用同一个 Sampler
+type Sampler struct {
+	cfg SamplingConfig
+
+	sites    sync.Map // caller pc => *sampleSite
+	numSites atomic.Int64
+	report   atomic.Pointer[reportCore] // 用于输出统计
+	once     sync.Once
+	stop     chan struct{}
+}
+
+func NewSampler(cfg SamplingConfig) *Sampler {
+	if cfg.Tick <= 0 {
+		cfg.Tick = time.Second
+	}
+	if cfg.First <= 0 {
+		cfg.First = 100
+	}
+	if cfg.ReportInterval <= 0 {
+		cfg.ReportInterval = time.Minute
+	}
+	return &Sampler{cfg: cfg, stop: make(chan struct{})}
+}
+
+type reportCore struct {
+	zapcore.Core
+}
+
+// allow 是否输出这条日志，没有 caller 或超过调用点数量上限时不采样
+// 不按消息内容区分调用点，格式化后的消息各不相同，会很快占满上限
+func (s *Sampler) allow(ent zapcore.Entry) bool {
+	if ent.Level >= zapcore.ErrorLevel || !ent.Caller.Defined {
+		return true
+	}
+	v, ok := s.sites.Load(ent.Caller.PC)
+	if !ok {
+		if s.numSites.Load() >= maxSampleSites {
+			return true
+		}
+		site := &sampleSite{level: ent.Level, caller: ent.Caller.TrimmedPath()}
+		site.msg.Store(ent.Message)
+		if v, ok = s.sites.LoadOrStore(ent.Caller.PC, site); !ok {
+			s.numSites.Add(1)
+			s.once.Do(func() {
+				go s.run()
+			})
+		}
+	}
+	site := v.(*sampleSite)
+
+	now := ent.Time.UnixNano()
+	resetAt := site.resetAt.Load()
+	if now > resetAt && site.resetAt.CompareAndSwap(resetAt, now+s.cfg.Tick.Nanoseconds()) {
+		site.count.Store(0)
+	}
+	n := site.count.Add(1)
+	if n <= int64(s.cfg.First) {
+		return true
+	}
+	if s.cfg.Thereafter > 0 && (n-int64(s.cfg.First))%int64(s.cfg.Thereafter) == 0 {
+		return true
+	}
+	site.suppressed.Add(1)
+	return false
+}
+
+func (s *Sampler) run() {
+	ticker := time.NewTicker(s.cfg.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.Report()
+			return
+		case <-ticker.C:
+			s.Report()
+		}
+	}
+}
+
+// Stop 停止定期输出统计，停止前输出最后一次
+func (s *Sampler) Stop() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// SampleStat 某个调用点被丢弃的条数
+type SampleStat struct {
+	Caller     string
+	Msg        string
+	Level      zapcore.Level
+	Suppressed int64
+}
+
+// Suppressed 返回并清零各调用点被丢弃的条数，按条数从多到少排序
+func (s *Sampler) Suppressed() []SampleStat {
+	var res []SampleStat
+	s.sites.Range(func(_, v interface{}) bool {
+		site := v.(*sampleSite)
+		if n := site.suppressed.Swap(0); n > 0 {
+			msg, _ := site.msg.Load().(string)
+			res = append(res, SampleStat{Caller: site.caller, Msg: msg, Level: site.level, Suppressed: n})
+		}
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Suppressed > res[j].Suppressed
+	})
+	return res
+}
+
+// evictIdle 删除 before 之前就已结束计数周期的调用点，避免调用点数量达到上限后不再采样
+func (s *Sampler) evictIdle(before time.Time) {
+	s.sites.Range(func(k, v interface{}) bool {
+		site := v.(*sampleSite)
+		if site.resetAt.Load() < before.UnixNano() && site.suppressed.Load() == 0 {
+			s.sites.Delete(k)
+			s.numSites.Add(-1)
+		}
+		return true
+	})
+}
+
+// Report 每个有丢弃的调用点输出一条 warn 日志，并清理空闲的调用点
+func (s *Sampler) Report() {
+	core := s.report.Load()
+	stats := s.Suppressed()
+	s.evictIdle(time.Now().Add(-s.cfg.ReportInterval))
+	if core == nil {
+		return
+	}
+	for _, stat := range stats {
+		ent := zapcore.Entry{Level: zapcore.WarnLevel, Time: time.Now(), LoggerName: "sampler", Message: "log sampling suppressed"}
+		if ce := core.Check(ent, nil); ce != nil {
+			ce.Write(
+				zap.String("caller", stat.Caller),
+				zap.String("sample_msg", stat.Msg),
+				zap.String("sample_level", stat.Level.String()),
+				zap.Int64("suppressed", stat.Suppressed),
+				zap.Duration("interval", s.cfg.ReportInterval),
+			)
+		}
+	}
+}
+
+// WrapCore 返回采样的 zapcore.Core，可用于 zap.WrapCore
+func (s *Sampler) WrapCore(core zapcore.Core) zapcore.Core {
+	if s == nil {
+		return core
+	}
+	// 默认 logger 创建时会覆盖为根 logger 的 core，其他 logger 只在没有设置时使用
+	s.report.CompareAndSwap(nil, &reportCore{core})
+	return &sampleCore{Core: core, s: s}
+}
+
+// sampleCore zap 在 Check 之后才填充 caller，所以在 Write 中采样
+type sampleCore struct {
+	zapcore.Core
+	s *Sampler
+}
+
+func (c *sampleCore) With(fields []zapcore.Field) zapcore.Core {
+	return &sampleCore{Core: c.Core.With(fields), s: c.s}
+}
+
+func (c *sampleCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sampleCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !c.s.allow(ent) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// WithSampling 按调用点采样，默认不采样
+func WithSampling(s *Sampler) Option {
+	return option(func(cfg *config) {
+		cfg.sampler = s
+	})
+}
+
+// SetSampler 修改采样，nil 表示不采样，同时修改所有子 logger
+func (l *LoggerZap) SetSampler(s *Sampler) {
+	if old := l.config.sampler; l.parent == nil && old != nil && old != s {
+		old.Stop()
+	}
+	l.config.sampler = s
+	l.SugaredLogger = l.newZapLogger().Sugar()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, child := range l.children {
+		child.SetSampler(s)
+	}
+}
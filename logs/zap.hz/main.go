@@ -1,48 +1,36 @@
 package zap
 
 import (
-	"context"
-	"log"
-	"os"
-	"path"
-	"time"
-
+	"github.com/EICHI-X/ptools/logs"
 	"github.com/cloudwego/kitex/pkg/klog"
-	"gopkg.in/natefinch/lumberjack.v2"
+	"go.uber.org/zap"
 )
-func init(){
-    var logFilePath string
-	dir := "./"
-	logFilePath = dir + "/logs/"
-	if err := os.MkdirAll(logFilePath, 0o777); err != nil {
-		log.Println(err.Error())
-		return
-	}
 
-	// 将文件名设置为日期
-	logFileName := time.Now().Format("2006-01-02") + ".log"
-	fileName := path.Join(logFilePath, logFileName)
-	if _, err := os.Stat(fileName); err != nil {
-		if _, err := os.Create(fileName); err != nil {
-			log.Println(err.Error())
-			return
-		}
+// Init 按 logs.Config 把 kitex 的 klog 设置为本包的 Logger，需要在 main 中显式调用
+func Init(cfg logs.Config) error {
+	level, err := cfg.GetLevel()
+	if err != nil {
+		return err
 	}
-
-	// logger := hertzlogrus.NewLogger()
-	// 提供压缩和删除
-	lumberjackLogger := &lumberjack.Logger{
-		Filename:   fileName,
-		MaxSize:    20,   // 一个文件最大可达 20M。
-		MaxBackups: 5,    // 最多同时保存 5 个文件。
-		MaxAge:     10,   // 一个文件最多可以保存 10 天。
-		Compress:   true, // 用 gzip 压缩。
+	enc, err := cfg.Encoder()
+	if err != nil {
+		return err
+	}
+	w, err := cfg.Writer()
+	if err != nil {
+		return err
+	}
+	opts := []Option{WithCoreEnc(enc)}
+	if r := cfg.GetRedactor(); r != nil {
+		opts = append(opts, WithZapOptions(zap.WrapCore(r.WrapCore)))
+	}
+	// 采样在打码之前，丢弃的日志不需要打码
+	if sampler := cfg.GetSampler(); sampler != nil {
+		opts = append(opts, WithZapOptions(zap.WrapCore(sampler.WrapCore)))
 	}
-	
-	// logus := kitexlogrus.NewLogger()
-	  klog.SetLogger(NewLogger())
-	// klog.SetLogger(logus)
-	klog.SetLevel(klog.LevelDebug)
-	klog.SetOutput(lumberjackLogger)
-	klog.CtxInfof(context.TODO(), "init")
-}
\ No newline at end of file
+	klog.SetLogger(NewLogger(opts...))
+	// logs.Level 与 klog.Level 取值一一对应
+	klog.SetLevel(klog.Level(level))
+	klog.SetOutput(w)
+	return nil
+}
@@ -0,0 +1,185 @@
+package oss
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// TransportOption minio 客户端 http 连接池参数
+type TransportOption struct {
+	MaxIdleConns          int           // 全部 host 的最大空闲连接数
+	MaxIdleConnsPerHost   int           // 单个 host 的最大空闲连接数
+	MaxConnsPerHost       int           // 单个 host 的最大连接数，0 表示不限制
+	IdleConnTimeout       time.Duration // 空闲连接保留时间
+	ResponseHeaderTimeout time.Duration // 等待响应头的超时时间
+	TLSHandshakeTimeout   time.Duration // TLS 握手超时时间
+}
+
+// DefaultTransportOption 默认连接池参数，适合单个 endpoint 的高并发读写
+func DefaultTransportOption() TransportOption {
+	return TransportOption{
+		MaxIdleConns:          512,
+		MaxIdleConnsPerHost:   128,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		TLSHandshakeTimeout:   10 * time.Second,
+	}
+}
+
+// NewTransport 在 minio.DefaultTransport 的基础上按 opt 调整连接池
+func NewTransport(secure bool, opt TransportOption) (*http.Transport, error) {
+	tr, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	if opt.MaxIdleConns > 0 {
+		tr.MaxIdleConns = opt.MaxIdleConns
+	}
+	if opt.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = opt.MaxIdleConnsPerHost
+	}
+	if opt.MaxConnsPerHost > 0 {
+		tr.MaxConnsPerHost = opt.MaxConnsPerHost
+	}
+	if opt.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = opt.IdleConnTimeout
+	}
+	if opt.ResponseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = opt.ResponseHeaderTimeout
+	}
+	if opt.TLSHandshakeTimeout > 0 {
+		tr.TLSHandshakeTimeout = opt.TLSHandshakeTimeout
+	}
+	return tr, nil
+}
+
+// FuncProvider 通过 Fetch 获取凭证，每隔 Refresh 重新获取一次，用于密钥轮换
+// minio 在每次签名前都会检查 IsExpired，过期后自动调用 Retrieve
+type FuncProvider struct {
+	credentials.Expiry
+	Fetch   func() (credentials.Value, error)
+	Refresh time.Duration
+}
+
+func (p *FuncProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.Fetch()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	refresh := p.Refresh
+	if refresh <= 0 {
+		refresh = 5 * time.Minute
+	}
+	p.SetExpiration(time.Now().Add(refresh), 0)
+	return v, nil
+}
+
+type OssLoaderOption func(o *OssLoader)
+
+// WithUseSSL 是否使用 https 访问 endpoint
+func WithUseSSL(useSSL bool) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.UseSSL = useSSL
+	}
+}
+
+// WithStaticCredentials 固定的 ak/sk
+func WithStaticCredentials(accessKeyID string, secretAccessKey string) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.AccessKeyID = accessKeyID
+		o.SecretAccessKey = secretAccessKey
+	}
+}
+
+// WithCredentialsProvider 使用自定义凭证来源，凭证过期后会自动重新获取
+func WithCredentialsProvider(provider credentials.Provider) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Creds = credentials.New(provider)
+	}
+}
+
+// WithTransport 自定义 http transport，不设置时使用 NewTransport(UseSSL, DefaultTransportOption())
+func WithTransport(transport http.RoundTripper) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Transport = transport
+	}
+}
+
+// WithRegion 设置 bucket 所在 region，避免每次请求前查询 region
+func WithRegion(region string) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Region = region
+	}
+}
+
+// WithUploadValidator 上传前校验类型、大小并扫描内容，见 UploadValidator
+func WithUploadValidator(v *UploadValidator) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Validator = v
+	}
+}
+
+// NewOssLoaderWithOptions 创建 OssLoader，内部持有一个长连接的 minio 客户端
+// 配置了 RefCodec 但没有 Key 且不接受旧格式时返回错误，没有配置 Key 时输出错误日志，私有 bucket 的引用无法解析
+func NewOssLoaderWithOptions(endpoint string, opts ...OssLoaderOption) (*OssLoader, error) {
+	p := &OssLoader{
+		Endpoint: endpoint,
+		UseSSL:   false,
+		Host:     endpoint,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if err := p.checkRefs(); err != nil {
+		return nil, err
+	}
+	if _, err := p.GetClient(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (u *OssLoader) newMinioClient() (*minio.Client, error) {
+	return u.newMinioClientFor(u.Endpoint, u.Region)
+}
+
+// newMinioClientFor 使用 OssLoader 的凭证和 transport 创建访问 endpoint 的客户端
+func (u *OssLoader) newMinioClientFor(endpoint string, region string) (*minio.Client, error) {
+	creds := u.Creds
+	if creds == nil {
+		creds = credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, "")
+	}
+	transport := u.Transport
+	if transport == nil {
+		tr, err := NewTransport(u.UseSSL, DefaultTransportOption())
+		if err != nil {
+			return nil, err
+		}
+		transport = tr
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    u.UseSSL,
+		Transport: transport,
+		Region:    region,
+	})
+}
+
+// GetClient 返回共享的 minio 客户端，OssLoader 直接用结构体构造时在第一次调用时创建
+func (u *OssLoader) GetClient() (*minio.Client, error) {
+	u.clientMu.Lock()
+	defer u.clientMu.Unlock()
+	if u.MinioClient != nil {
+		return u.MinioClient, nil
+	}
+	minioClient, err := u.newMinioClient()
+	if err != nil {
+		return nil, err
+	}
+	u.MinioClient = minioClient
+	return minioClient, nil
+}
@@ -0,0 +1,255 @@
+package oss
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/paerospike"
+	aerospike "github.com/aerospike/aerospike-client-go/v6"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultContentPrefix = "cas/"
+	DefaultStagingPrefix = "staging/"
+	refCountBin          = "ref"
+)
+
+// RefCounter 内容引用计数，返回变更后的计数
+type RefCounter interface {
+	Incr(ctx context.Context, hash string, delta int64) (int64, error)
+}
+
+// AerospikeRefCounter 基于 aerospike 原子加的引用计数
+type AerospikeRefCounter struct {
+	Client     *paerospike.Client
+	KeyPattern string // 格式必须是 appid|project|key，默认 1000|oss|file_ref.%v
+}
+
+func NewAerospikeRefCounter(psm string) *AerospikeRefCounter {
+	return &AerospikeRefCounter{
+		Client:     paerospike.NewDefaultClient(psm),
+		KeyPattern: "1000|oss|file_ref.%v",
+	}
+}
+
+func (c *AerospikeRefCounter) Incr(ctx context.Context, hash string, delta int64) (int64, error) {
+	if c.Client == nil {
+		return 0, fmt.Errorf("AerospikeRefCounter client is nil")
+	}
+	key := fmt.Sprintf(c.KeyPattern, hash)
+	r, err := c.Client.Operate(key, []*aerospike.Operation{
+		aerospike.AddOp(aerospike.NewBin(refCountBin, delta)),
+		aerospike.GetBinOp(refCountBin),
+	}, 0, nil)
+	if err != nil || r == nil {
+		return 0, errors.WithMessage(err, "AerospikeRefCounter incr fail")
+	}
+	switch v := r.Bins[refCountBin].(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("AerospikeRefCounter value type not valid %T", r.Bins[refCountBin])
+}
+
+// Deduper 按内容 md5 去重上传，相同内容在 bucket 中只保存一份，每个 owner 各自一条 Blog_file 记录
+// 通过 WithDedup 配置后，UploadFromForm、UploadFromFile 上传到 Bucket 时自动去重
+type Deduper struct {
+	Loader        *OssLoader
+	Bucket        string
+	ContentPrefix string // 内容对象前缀，对象名为 ContentPrefix + md5[:2] + "/" + md5
+	StagingPrefix string // 无法 seek 的流先上传到这里，算出 md5 后再搬到内容对象
+	RefCounter    RefCounter
+}
+
+func NewDeduper(loader *OssLoader, bucket string, refCounter RefCounter) *Deduper {
+	return &Deduper{
+		Loader:        loader,
+		Bucket:        bucket,
+		ContentPrefix: DefaultContentPrefix,
+		StagingPrefix: DefaultStagingPrefix,
+		RefCounter:    refCounter,
+	}
+}
+
+// WithDedup 上传到 d.Bucket 的文件按内容去重，d.Loader 为空时使用当前 OssLoader
+func WithDedup(d *Deduper) OssLoaderOption {
+	return func(o *OssLoader) {
+		if d.Loader == nil {
+			d.Loader = o
+		}
+		o.Dedup = d
+	}
+}
+
+// dedupFor 上传到 bucket 时使用的 Deduper，没有配置或 bucket 不同时返回 nil
+func (u *OssLoader) dedupFor(bucket string) *Deduper {
+	if u.Dedup == nil || u.Dedup.Bucket != bucket {
+		return nil
+	}
+	return u.Dedup
+}
+
+// uploadDedup 校验后去重上传，配额在 Deduper 算出 md5 之后检查
+func (u *OssLoader) uploadDedup(ctx context.Context, d *Deduper, file io.Reader, fileObj *multipart.FileHeader) (*Blog_file, error) {
+	reader, _, err := u.validateContent(ctx, d.Bucket, file, fileObj)
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := d.Upload(ctx, reader, fileObj.Size, fileObj.Filename, fileObj.Header.Get("Content-Type"), ownerFromCtx(ctx))
+	return record, err
+}
+
+// ContentKey md5 对应的内容对象名
+func (d *Deduper) ContentKey(hash string) string {
+	if len(hash) < 2 {
+		return d.ContentPrefix + hash
+	}
+	return d.ContentPrefix + hash[:2] + "/" + hash
+}
+
+// Upload 边上传边计算 md5：先传到 staging，内容已存在时删除 staging 直接引用已有内容，否则在服务端复制为内容对象
+// 返回值 hit 表示是否命中去重；同一个 owner 重复上传直接返回已有记录，不检查也不增加配额
+func (d *Deduper) Upload(ctx context.Context, file io.Reader, size int64, filename string, contentType string, owner string) (record *Blog_file, hit bool, err error) {
+	minioClient, err := d.Loader.GetClient()
+	if err != nil {
+		return nil, false, err
+	}
+	h := md5.New()
+	var plainSize int64
+	reader := &progressReader{r: io.TeeReader(file, h), progress: func(n int64) { plainSize += n }}
+	stagingKey := d.StagingPrefix + uuid.NewString()
+	// 配置了 Envelope 时 staging 加密保存，复制为内容对象时保留加密元数据
+	if _, err = d.Loader.putObject(ctx, d.Bucket, stagingKey, reader, size, minio.PutObjectOptions{ContentType: contentType}); err != nil {
+		return nil, false, errors.WithMessage(err, "Deduper staging upload fail")
+	}
+	defer func() {
+		// 请求被取消时也要清理 staging 对象
+		if err := minioClient.RemoveObject(context.WithoutCancel(ctx), d.Bucket, stagingKey, minio.RemoveObjectOptions{}); err != nil {
+			logs.CtxWarnf(ctx, "Deduper remove staging %v fail %v", stagingKey, err)
+		}
+	}()
+	size = plainSize
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	if existing := d.findExisting(ctx, hash, owner); existing != nil {
+		if existing.Owner == owner {
+			return existing, true, nil
+		}
+		if existing.Size > 0 {
+			size = existing.Size
+		}
+		if err = d.Loader.CheckQuota(ctx, owner, size); err != nil {
+			return nil, false, err
+		}
+		record, err = d.addReference(ctx, existing.MinioKey, hash, filename, contentType, owner, size)
+		return record, true, err
+	}
+
+	if err = d.Loader.CheckQuota(ctx, owner, size); err != nil {
+		return nil, false, err
+	}
+	contentKey := d.ContentKey(hash)
+	stat, statErr := minioClient.StatObject(ctx, d.Bucket, contentKey, minio.StatObjectOptions{})
+	if statErr == nil && stat.Size > 0 {
+		hit = true
+		size = stat.Size
+	} else {
+		_, err = minioClient.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: d.Bucket, Object: contentKey},
+			minio.CopySrcOptions{Bucket: d.Bucket, Object: stagingKey})
+		if err != nil {
+			return nil, false, errors.WithMessage(err, "Deduper copy staging fail")
+		}
+	}
+	record, err = d.addReference(ctx, contentKey, hash, filename, contentType, owner, size)
+	return record, hit, err
+}
+
+func (d *Deduper) findExisting(ctx context.Context, hash string, owner string) *Blog_file {
+	files, err := d.Loader.queryFileByMd5(ctx, hash)
+	if err != nil {
+		logs.CtxWarnf(ctx, "Deduper query hash %v fail %v", hash, err)
+		return nil
+	}
+	var found *Blog_file
+	for _, f := range files {
+		if f == nil || f.Bucket != d.Bucket {
+			continue
+		}
+		if f.Owner == owner {
+			return f
+		}
+		if found == nil {
+			found = f
+		}
+	}
+	return found
+}
+
+func (d *Deduper) addReference(ctx context.Context, contentKey string, hash string, filename string, contentType string, owner string, size int64) (*Blog_file, error) {
+	if d.RefCounter != nil {
+		if _, err := d.RefCounter.Incr(ctx, hash, 1); err != nil {
+			return nil, err
+		}
+	}
+	record := &Blog_file{
+		Filename:    filename,
+		ContentType: contentType,
+		Owner:       owner,
+		Url:         d.Loader.objectRef(d.Bucket, contentKey),
+		Path:        contentKey,
+		Bucket:      d.Bucket,
+		Md5:         hash,
+		Prefix:      d.ContentPrefix,
+		MinioKey:    contentKey,
+		SaveType:    SaveTypeMinio,
+		Size:        size,
+	}
+	saved, err := d.Loader.saveFile(ctx, record)
+	if err != nil && d.RefCounter != nil {
+		// 记录保存失败时回滚引用计数，否则内容对象永远不会被回收
+		if _, decrErr := d.RefCounter.Incr(context.WithoutCancel(ctx), hash, -1); decrErr != nil {
+			logs.CtxErrorf(ctx, "Deduper rollback ref %v fail %v", hash, decrErr)
+		}
+	}
+	return saved, err
+}
+
+// Release 软删除 owner 的记录并释放对内容的引用，引用数降为 0 时才删除内容对象，返回内容对象是否被删除
+func (d *Deduper) Release(ctx context.Context, record *Blog_file) (bool, error) {
+	if record == nil || record.Md5 == "" || !strings.HasPrefix(record.MinioKey, d.ContentPrefix) {
+		return false, fmt.Errorf("Deduper release record not valid")
+	}
+	if err := d.Loader.SoftDeleteFile(ctx, record); err != nil {
+		return false, err
+	}
+	if d.RefCounter == nil {
+		return false, nil
+	}
+	count, err := d.RefCounter.Incr(ctx, record.Md5, -1)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	minioClient, err := d.Loader.GetClient()
+	if err != nil {
+		return false, err
+	}
+	if err := minioClient.RemoveObject(ctx, record.Bucket, record.MinioKey, minio.RemoveObjectOptions{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,622 @@
+package oss
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	EncryptAlgorithm        = "AES256-GCM-CHUNK"
+	DefaultEncryptChunkSize = 64 << 10
+	MasterKeySize           = 32
+
+	DefaultMasterKeysEnv  = "OSS_MASTER_KEYS"
+	DefaultMasterKeyIdEnv = "OSS_MASTER_KEY_ID"
+
+	// 对象元数据中保存的加密信息，minio 返回的 UserMetadata 的 key 为这种格式
+	metaEncAlg       = "Enc-Alg"
+	metaEncKeyId     = "Enc-Key-Id"
+	metaEncKey       = "Enc-Key"
+	metaEncNonce     = "Enc-Nonce"
+	metaEncChunk     = "Enc-Chunk-Size"
+	metaEncPlainSize = "Enc-Plain-Size"
+
+	gcmTagSize = 16
+)
+
+// KeyProvider 提供主密钥，主密钥只用于加解密每个对象的数据密钥
+// 轮换时新增一个 key id 并设为当前，旧 key 保留到 RewrapJob 处理完所有对象
+type KeyProvider interface {
+	CurrentKeyId() string
+	MasterKey(keyId string) ([]byte, error)
+}
+
+// StaticKeyProvider 内存中的主密钥，key 为 32 字节
+type StaticKeyProvider struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKeyId() string {
+	return p.Current
+}
+
+func (p *StaticKeyProvider) MasterKey(keyId string) ([]byte, error) {
+	key, ok := p.Keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("master key %v not found", keyId)
+	}
+	return key, nil
+}
+
+// ParseMasterKeys 解析 id:base64key 格式的主密钥，多个以换行或逗号分隔，# 开头为注释
+// current 为空时使用最后一个
+func ParseMasterKeys(s string, current string) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{Current: current, Keys: map[string][]byte{}}
+	last := ""
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("master key line not valid")
+		}
+		id := strings.TrimSpace(line[:i])
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("master key %v not valid base64", id))
+		}
+		if len(key) != MasterKeySize {
+			return nil, fmt.Errorf("master key %v must be %v bytes", id, MasterKeySize)
+		}
+		p.Keys[id] = key
+		last = id
+	}
+	if p.Current == "" {
+		p.Current = last
+	}
+	if _, ok := p.Keys[p.Current]; !ok {
+		return nil, fmt.Errorf("current master key %v not found", p.Current)
+	}
+	return p, nil
+}
+
+// NewFileKeyProvider 从文件读取主密钥，格式见 ParseMasterKeys
+func NewFileKeyProvider(path string, current string) (*StaticKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKeys(string(data), current)
+}
+
+// NewEnvKeyProvider 从环境变量读取主密钥，为空时使用 OSS_MASTER_KEYS 和 OSS_MASTER_KEY_ID
+func NewEnvKeyProvider(keysEnv string, keyIdEnv string) (*StaticKeyProvider, error) {
+	if keysEnv == "" {
+		keysEnv = DefaultMasterKeysEnv
+	}
+	if keyIdEnv == "" {
+		keyIdEnv = DefaultMasterKeyIdEnv
+	}
+	return ParseMasterKeys(os.Getenv(keysEnv), os.Getenv(keyIdEnv))
+}
+
+// WithEnvelope DownLoadFile、DownLoadObject 自动解密信封加密的对象，e.Loader 为空时使用当前 OssLoader
+func WithEnvelope(e *Envelope) OssLoaderOption {
+	return func(o *OssLoader) {
+		if e.Loader == nil {
+			e.Loader = o
+		}
+		o.Envelope = e
+	}
+}
+
+// openObject 加密的对象返回解密后的内容，没有配置 Envelope 时返回错误，避免把密文当作明文返回
+func (u *OssLoader) openObject(obj *minio.Object, stat minio.ObjectInfo) (ObjectReader, error) {
+	if !IsEncrypted(stat) {
+		return obj, nil
+	}
+	if u.Envelope == nil {
+		obj.Close()
+		return nil, fmt.Errorf("object %v is encrypted but envelope not configured", stat.Key)
+	}
+	dec, err := u.Envelope.Decrypt(obj, stat)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return dec, nil
+}
+
+// putObject 上传对象，配置了 Envelope 时加密保存；加密对象的 ETag 是密文的 md5，返回时清空，Size 为明文大小
+func (u *OssLoader) putObject(ctx context.Context, bucket string, object string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	if u.Envelope == nil {
+		minioClient, err := u.GetClient()
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		return minioClient.PutObject(ctx, bucket, object, reader, size, opts)
+	}
+	info, err := u.Envelope.UploadEncrypted(ctx, bucket, object, reader, size, opts.ContentType)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	res := *info
+	res.ETag = ""
+	if size >= 0 {
+		res.Size = size
+	}
+	return res, nil
+}
+
+// Envelope 信封加密：每个对象随机生成数据密钥，内容按块 AES-GCM 加密，数据密钥由主密钥加密后存在对象元数据中
+type Envelope struct {
+	Loader    *OssLoader
+	Keys      KeyProvider
+	ChunkSize int // 明文分块大小，默认 64K
+}
+
+func NewEnvelope(loader *OssLoader, keys KeyProvider) *Envelope {
+	return &Envelope{Loader: loader, Keys: keys, ChunkSize: DefaultEncryptChunkSize}
+}
+
+func (e *Envelope) chunkSize() int {
+	if e.ChunkSize <= 0 {
+		return DefaultEncryptChunkSize
+	}
+	return e.ChunkSize
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey 用主密钥加密数据密钥，输出 nonce + 密文，keyId 作为附加数据防止替换
+func (e *Envelope) wrapKey(keyId string, dataKey []byte) (string, error) {
+	master, err := e.Keys.MasterKey(keyId)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGcm(master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, []byte(keyId))), nil
+}
+
+func (e *Envelope) unwrapKey(keyId string, wrapped string) ([]byte, error) {
+	master, err := e.Keys.MasterKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key not valid")
+	}
+	dataKey, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(keyId))
+	if err != nil {
+		return nil, errors.WithMessage(err, "unwrap data key fail")
+	}
+	return dataKey, nil
+}
+
+// EncryptedSize 明文大小对应的密文大小，每块多 16 字节 tag，空内容也有一个块
+func EncryptedSize(plainSize int64, chunkSize int) int64 {
+	if plainSize < 0 {
+		return -1
+	}
+	chunks := plainSize / int64(chunkSize)
+	if plainSize%int64(chunkSize) != 0 || plainSize == 0 {
+		chunks++
+	}
+	return plainSize + chunks*gcmTagSize
+}
+
+// chunkNonce 每块的 nonce 为基础 nonce 的后 8 字节异或块序号
+func chunkNonce(base []byte, index uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	n := len(nonce)
+	binary.BigEndian.PutUint64(nonce[n-8:], binary.BigEndian.Uint64(nonce[n-8:])^index)
+	return nonce
+}
+
+// chunkAad 附加数据包含是否最后一块，防止密文被截断
+func chunkAad(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// chunkReader 按块加密或解密，in 读满一块后 peek 一个字节判断是否最后一块
+type chunkReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	readLen int
+	encrypt bool
+	index   uint64
+	buf     []byte
+	out     []byte
+	done    bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *chunkReader) next() error {
+	n, err := io.ReadFull(r.in, r.buf[:r.readLen])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := err != nil
+	if !final {
+		if _, peekErr := r.in.Peek(1); peekErr == io.EOF {
+			final = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+	nonce := chunkNonce(r.nonce, r.index)
+	if r.encrypt {
+		r.out = r.aead.Seal(r.out[:0], nonce, r.buf[:n], chunkAad(final))
+	} else {
+		r.out, err = r.aead.Open(r.out[:0], nonce, r.buf[:n], chunkAad(final))
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("decrypt chunk %v fail", r.index))
+		}
+	}
+	r.index++
+	r.done = final
+	return nil
+}
+
+func newChunkReader(in io.Reader, dataKey []byte, nonce []byte, chunkSize int, encrypt bool) (*chunkReader, error) {
+	aead, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	readLen := chunkSize
+	if !encrypt {
+		readLen += gcmTagSize
+	}
+	return &chunkReader{
+		in:      bufio.NewReaderSize(in, readLen),
+		aead:    aead,
+		nonce:   nonce,
+		readLen: readLen,
+		encrypt: encrypt,
+		buf:     make([]byte, readLen),
+		out:     make([]byte, 0, chunkSize+gcmTagSize),
+	}, nil
+}
+
+// UploadEncrypted 加密后上传，size 为明文大小，未知时传 -1
+func (e *Envelope) UploadEncrypted(ctx context.Context, bucket string, object string, reader io.Reader, size int64, contentType string) (*minio.UploadInfo, error) {
+	minioClient, err := e.Loader.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	keyId := e.Keys.CurrentKeyId()
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped, err := e.wrapKey(keyId, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := e.chunkSize()
+	encReader, err := newChunkReader(reader, dataKey, nonce, chunkSize, true)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		metaEncAlg:   EncryptAlgorithm,
+		metaEncKeyId: keyId,
+		metaEncKey:   wrapped,
+		metaEncNonce: base64.StdEncoding.EncodeToString(nonce),
+		metaEncChunk: strconv.Itoa(chunkSize),
+	}
+	if size >= 0 {
+		meta[metaEncPlainSize] = strconv.FormatInt(size, 10)
+	}
+	info, err := minioClient.PutObject(ctx, bucket, object, encReader, EncryptedSize(size, chunkSize), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: meta,
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "UploadEncrypted fail")
+	}
+	return &info, nil
+}
+
+// DownloadDecrypted 下载并解密，未加密的对象返回错误；返回的 stat.Size 为明文大小
+func (e *Envelope) DownloadDecrypted(ctx context.Context, bucket string, object string) (io.ReadCloser, *minio.ObjectInfo, error) {
+	minioClient, err := e.Loader.GetClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := minioClient.GetObject(ctx, bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, err
+	}
+	if !IsEncrypted(stat) {
+		obj.Close()
+		return nil, nil, fmt.Errorf("object %v/%v is not encrypted", bucket, object)
+	}
+	dec, err := e.Decrypt(obj, stat)
+	if err != nil {
+		obj.Close()
+		return nil, nil, err
+	}
+	stat, _ = dec.Stat()
+	return dec, &stat, nil
+}
+
+// IsEncrypted 对象元数据中是否有信封加密信息
+func IsEncrypted(stat minio.ObjectInfo) bool {
+	return stat.UserMetadata[metaEncAlg] == EncryptAlgorithm
+}
+
+// ObjectReader DownLoadFile 返回的对象内容，*minio.Object 和解密后的对象都实现了该接口，包含 *minio.Object 的 ReadAt
+type ObjectReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (minio.ObjectInfo, error)
+}
+
+// decryptedObject 解密后的对象，Seek 时定位到所在块重新解密，Stat 返回明文大小
+type decryptedObject struct {
+	obj       ObjectReader
+	r         *chunkReader
+	stat      minio.ObjectInfo
+	chunkSize int
+	offset    int64
+}
+
+// Decrypt 解密 obj，stat 为 obj 的元数据
+func (e *Envelope) Decrypt(obj ObjectReader, stat minio.ObjectInfo) (ObjectReader, error) {
+	meta := stat.UserMetadata
+	dataKey, err := e.unwrapKey(meta[metaEncKeyId], meta[metaEncKey])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(meta[metaEncNonce])
+	if err != nil || len(nonce) != 12 {
+		return nil, fmt.Errorf("object %v nonce not valid", stat.Key)
+	}
+	chunkSize, err := strconv.Atoi(meta[metaEncChunk])
+	if err != nil || chunkSize <= 0 {
+		return nil, fmt.Errorf("object %v chunk size not valid", stat.Key)
+	}
+	decReader, err := newChunkReader(obj, dataKey, nonce, chunkSize, false)
+	if err != nil {
+		return nil, err
+	}
+	stat.Size = PlainSize(stat.Size, chunkSize)
+	return &decryptedObject{obj: obj, r: decReader, stat: stat, chunkSize: chunkSize}, nil
+}
+
+// PlainSize 密文大小对应的明文大小，除最后一块外每块都是 chunkSize
+func PlainSize(encryptedSize int64, chunkSize int) int64 {
+	block := int64(chunkSize + gcmTagSize)
+	chunks := (encryptedSize + block - 1) / block
+	if chunks == 0 {
+		return 0
+	}
+	return encryptedSize - chunks*gcmTagSize
+}
+
+func (d *decryptedObject) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *decryptedObject) Close() error {
+	return d.obj.Close()
+}
+
+func (d *decryptedObject) Stat() (minio.ObjectInfo, error) {
+	return d.stat, nil
+}
+
+// Seek 定位到 offset 所在的块，从块开头解密并丢弃块内 offset 之前的部分
+func (d *decryptedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.stat.Size
+	}
+	if offset < 0 || offset > d.stat.Size {
+		return 0, fmt.Errorf("seek offset %v not valid", offset)
+	}
+	d.r.out = d.r.out[:0]
+	if offset == d.stat.Size {
+		// 已到结尾，之后读取直接返回 EOF
+		d.r.done = true
+		d.offset = offset
+		return offset, nil
+	}
+	chunk := offset / int64(d.chunkSize)
+	if _, err := d.obj.Seek(chunk*int64(d.chunkSize+gcmTagSize), io.SeekStart); err != nil {
+		return 0, err
+	}
+	d.r.in.Reset(d.obj)
+	d.r.index = uint64(chunk)
+	d.r.done = false
+	d.offset = chunk * int64(d.chunkSize)
+	if _, err := io.CopyN(io.Discard, d, offset-d.offset); err != nil {
+		return 0, err
+	}
+	return d.offset, nil
+}
+
+// ReadAt 读取 off 所在的各块并解密，不影响 Read 的位置
+func (d *decryptedObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read offset %v not valid", off)
+	}
+	n := 0
+	for n < len(p) && off < d.stat.Size {
+		chunk := off / int64(d.chunkSize)
+		plain, err := d.readChunk(chunk)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-chunk*int64(d.chunkSize):])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk 按块序号读取密文并解密
+func (d *decryptedObject) readChunk(chunk int64) ([]byte, error) {
+	block := int64(d.chunkSize + gcmTagSize)
+	encSize := EncryptedSize(d.stat.Size, d.chunkSize)
+	start := chunk * block
+	end := start + block
+	if end > encSize {
+		end = encSize
+	}
+	buf := make([]byte, end-start)
+	if n, err := d.obj.ReadAt(buf, start); n < len(buf) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	final := end == encSize
+	plain, err := d.r.aead.Open(nil, chunkNonce(d.r.nonce, uint64(chunk)), buf, chunkAad(final))
+	if err != nil {
+		return nil, errors.WithMessage(err, "decrypt chunk fail")
+	}
+	return plain, nil
+}
+
+// Rewrap 用当前主密钥重新加密对象的数据密钥，只改元数据不重写内容，返回是否有变更
+func (e *Envelope) Rewrap(ctx context.Context, bucket string, object string) (bool, error) {
+	minioClient, err := e.Loader.GetClient()
+	if err != nil {
+		return false, err
+	}
+	stat, err := minioClient.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	meta := stat.UserMetadata
+	current := e.Keys.CurrentKeyId()
+	if meta[metaEncAlg] != EncryptAlgorithm || meta[metaEncKeyId] == current {
+		return false, nil
+	}
+	dataKey, err := e.unwrapKey(meta[metaEncKeyId], meta[metaEncKey])
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := e.wrapKey(current, dataKey)
+	if err != nil {
+		return false, err
+	}
+	newMeta := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		newMeta[k] = v
+	}
+	newMeta[metaEncKeyId] = current
+	newMeta[metaEncKey] = wrapped
+	// 替换元数据时 Content-Type 也需要带上
+	if stat.ContentType != "" {
+		newMeta["Content-Type"] = stat.ContentType
+	}
+	if _, err := e.Loader.CopyObject(ctx, bucket, object, bucket, object, newMeta); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RewrapJob 主密钥轮换后，把 Prefix 下用旧主密钥加密的对象重新加密数据密钥
+type RewrapJob struct {
+	Envelope *Envelope
+	Bucket   string
+	Prefix   string
+}
+
+// RunOnce 处理一遍，返回重新加密的对象数，单个对象失败只打日志
+func (j *RewrapJob) RunOnce(ctx context.Context) (int, error) {
+	minioClient, err := j.Envelope.Loader.GetClient()
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for obj := range minioClient.ListObjects(ctx, j.Bucket, minio.ListObjectsOptions{Prefix: j.Prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return rewrapped, obj.Err
+		}
+		changed, err := j.Envelope.Rewrap(ctx, j.Bucket, obj.Key)
+		if err != nil {
+			logs.CtxWarnf(ctx, "RewrapJob bucket=%v object=%v fail %v", j.Bucket, obj.Key, err)
+			continue
+		}
+		if changed {
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
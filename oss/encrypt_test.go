@@ -0,0 +1,76 @@
+package oss
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+type bytesObject struct {
+	*bytes.Reader
+	stat minio.ObjectInfo
+}
+
+func (o *bytesObject) Close() error                    { return nil }
+func (o *bytesObject) Stat() (minio.ObjectInfo, error) { return o.stat, nil }
+
+// encryptForTest 按 UploadEncrypted 的格式加密 plain，返回可以交给 Decrypt 的对象
+func encryptForTest(t *testing.T, e *Envelope, plain []byte) (ObjectReader, minio.ObjectInfo) {
+	dataKey := bytes.Repeat([]byte{7}, 32)
+	nonce := bytes.Repeat([]byte{3}, 12)
+	wrapped, err := e.wrapKey(e.Keys.CurrentKeyId(), dataKey)
+	assert.NoError(t, err)
+	r, err := newChunkReader(bytes.NewReader(plain), dataKey, nonce, e.ChunkSize, true)
+	assert.NoError(t, err)
+	enc, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	stat := minio.ObjectInfo{Key: "a", Size: int64(len(enc)), UserMetadata: map[string]string{
+		metaEncAlg:   EncryptAlgorithm,
+		metaEncKeyId: e.Keys.CurrentKeyId(),
+		metaEncKey:   wrapped,
+		metaEncNonce: base64.StdEncoding.EncodeToString(nonce),
+		metaEncChunk: strconv.Itoa(e.ChunkSize),
+	}}
+	return &bytesObject{Reader: bytes.NewReader(enc), stat: stat}, stat
+}
+
+func TestDecryptedObjectReadAt(t *testing.T) {
+	e := &Envelope{Keys: &StaticKeyProvider{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}, ChunkSize: 16}
+	for _, size := range []int{0, 10, 16, 32, 45} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i)
+		}
+		obj, stat := encryptForTest(t, e, plain)
+		dec, err := e.Decrypt(obj, stat)
+		assert.NoError(t, err)
+
+		all, err := io.ReadAll(dec)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, all, "size %v", size)
+
+		for _, off := range []int{0, 5, 15, 16, 17, 31} {
+			if off >= size {
+				continue
+			}
+			buf := make([]byte, 12)
+			n, err := dec.ReadAt(buf, int64(off))
+			want := plain[off:]
+			if len(want) > len(buf) {
+				want = want[:len(buf)]
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, io.EOF, err)
+			}
+			assert.Equal(t, want, buf[:n], "size %v off %v", size, off)
+		}
+		n, err := dec.ReadAt(make([]byte, 1), int64(size))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, io.EOF, err)
+	}
+}
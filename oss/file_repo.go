@@ -0,0 +1,280 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EICHI-X/ptools/pmodel"
+	"github.com/EICHI-X/ptools/ppostgres"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DefaultFilePageSize = 20
+	MaxFilePageSize     = 200
+)
+
+// FileRepository Blog_file 元数据的持久化，(url, owner) 唯一，删除为软删除
+type FileRepository struct {
+	DB *gorm.DB
+}
+
+func NewFileRepository(db *gorm.DB) *FileRepository {
+	return &FileRepository{DB: db}
+}
+
+// NewFileRepositoryByPSM 通过 ppostgres.GetDbByPSM 连接数据库，psm 如 wealth.stock.mainstore
+func NewFileRepositoryByPSM(ctx context.Context, psm string) (*FileRepository, error) {
+	db, err := ppostgres.GetDbByPSM(ctx, psm)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileRepository(db), nil
+}
+
+var defaultFileRepository *FileRepository
+
+// SetFileRepository 设置包级别默认的元数据仓库，QueryFileInfoFromSlqUrl 等函数和未设置 FileRepo 的 OssLoader 都会使用
+func SetFileRepository(r *FileRepository) {
+	defaultFileRepository = r
+}
+
+func GetFileRepository() *FileRepository {
+	return defaultFileRepository
+}
+
+// AutoMigrate 建表并创建 url、md5、owner 索引
+func (r *FileRepository) AutoMigrate(ctx context.Context) error {
+	return r.DB.WithContext(ctx).AutoMigrate(&Blog_file{})
+}
+
+// fileUpsertColumns (url, owner) 冲突时更新的字段
+var fileUpsertColumns = []string{
+	"filename", "content_type", "href", "path", "bucket", "alt", "md5",
+	"prefix", "minio_key", "save_type", "variants", "size", "updated_at", "deleted_at",
+}
+
+// Upsert 按 (url, owner) 插入或更新，已软删除的记录会被恢复
+func (r *FileRepository) Upsert(ctx context.Context, data *Blog_file) (*Blog_file, error) {
+	if data == nil || data.Url == "" {
+		return data, fmt.Errorf("Upsert file url is empty")
+	}
+	data.DeletedAt = gorm.DeletedAt{}
+	err := r.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "url"}, {Name: "owner"}},
+		DoUpdates: clause.AssignmentColumns(fileUpsertColumns),
+	}).Create(data).Error
+	if err != nil {
+		return data, errors.WithMessage(err, "Upsert file fail")
+	}
+	return data, nil
+}
+
+// Save 与 Upsert 相同，同时返回被覆盖的未删除记录，新增或恢复软删除记录时 prev 为 nil
+// 在一个事务内先插入，冲突时锁住已有记录再更新，并发保存同一个 (url, owner) 时只有一个会被当作新增
+func (r *FileRepository) Save(ctx context.Context, data *Blog_file) (prev *Blog_file, err error) {
+	if data == nil || data.Url == "" {
+		return nil, fmt.Errorf("Save file url is empty")
+	}
+	data.DeletedAt = gorm.DeletedAt{}
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "url"}, {Name: "owner"}},
+			DoNothing: true,
+		}).Create(data)
+		if res.Error != nil || res.RowsAffected > 0 {
+			return res.Error
+		}
+		old := &Blog_file{}
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("url = ? AND owner = ?", data.Url, data.Owner).Take(old).Error; err != nil {
+			return err
+		}
+		if !old.DeletedAt.Valid {
+			prev = old
+		}
+		data.ID, data.CreatedAt = old.ID, old.CreatedAt
+		return tx.Unscoped().Model(&Blog_file{}).Where("id = ?", old.ID).Select(fileUpsertColumns).Updates(data).Error
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Save file fail")
+	}
+	return prev, nil
+}
+
+func (r *FileRepository) QueryByUrl(ctx context.Context, url string) ([]*Blog_file, error) {
+	data := make([]*Blog_file, 0)
+	err := r.DB.WithContext(ctx).Where("url = ?", url).Find(&data).Error
+	return data, err
+}
+
+// QueryByUrlOwner 查询 owner 未删除的记录，不存在时返回 nil
+func (r *FileRepository) QueryByUrlOwner(ctx context.Context, url string, owner string) (*Blog_file, error) {
+	data := make([]*Blog_file, 0, 1)
+	if err := r.DB.WithContext(ctx).Where("url = ? AND owner = ?", url, owner).Limit(1).Find(&data).Error; err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data[0], nil
+}
+
+// QueryByObject 查询引用 bucket 中某个对象的所有未删除记录
+func (r *FileRepository) QueryByObject(ctx context.Context, bucket string, key string) ([]*Blog_file, error) {
+	data := make([]*Blog_file, 0)
+	err := r.DB.WithContext(ctx).Where("bucket = ? AND minio_key = ?", bucket, key).Find(&data).Error
+	return data, err
+}
+
+func (r *FileRepository) QueryByMd5(ctx context.Context, md5 string) ([]*Blog_file, error) {
+	data := make([]*Blog_file, 0)
+	err := r.DB.WithContext(ctx).Where("md5 = ?", md5).Order("id").Find(&data).Error
+	return data, err
+}
+
+// ListByOwner 按创建时间倒序分页列出 owner 的文件，page 从 1 开始，返回总数
+func (r *FileRepository) ListByOwner(ctx context.Context, owner string, page int, pageSize int) ([]*Blog_file, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultFilePageSize
+	}
+	if pageSize > MaxFilePageSize {
+		pageSize = MaxFilePageSize
+	}
+	data := make([]*Blog_file, 0, pageSize)
+	var total int64
+	db := r.DB.WithContext(ctx).Model(&Blog_file{}).Where("owner = ?", owner).Session(&gorm.Session{})
+	if err := db.Count(&total).Error; err != nil {
+		return data, 0, err
+	}
+	err := db.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&data).Error
+	return data, total, err
+}
+
+// SoftDelete 软删除 owner 的某个文件记录，不会删除存储中的对象
+func (r *FileRepository) SoftDelete(ctx context.Context, url string, owner string) error {
+	return r.DB.WithContext(ctx).Where("url = ? AND owner = ?", url, owner).Delete(&Blog_file{}).Error
+}
+
+// OwnerUsage 按 owner 汇总的用量
+type OwnerUsage struct {
+	Owner   string
+	Bytes   int64
+	Objects int64
+}
+
+// UsageByOwner 按 owner 汇总未删除记录的大小和数量，只有已删除记录的 owner 也会返回，用量为 0
+func (r *FileRepository) UsageByOwner(ctx context.Context) ([]*OwnerUsage, error) {
+	data := make([]*OwnerUsage, 0)
+	err := r.DB.WithContext(ctx).Unscoped().Model(&Blog_file{}).
+		Select("owner, COALESCE(SUM(CASE WHEN deleted_at IS NULL THEN size ELSE 0 END), 0) AS bytes, COUNT(CASE WHEN deleted_at IS NULL THEN 1 END) AS objects").
+		Where("owner <> ''").Group("owner").Scan(&data).Error
+	return data, err
+}
+
+// ListWithoutSize 列出 size 为 0 的记录，用于补齐 size 字段上线前的数据
+func (r *FileRepository) ListWithoutSize(ctx context.Context, afterId int64, limit int) ([]*Blog_file, error) {
+	data := make([]*Blog_file, 0, limit)
+	err := r.DB.WithContext(ctx).Where("size = 0 AND id > ?", afterId).Order("id").Limit(limit).Find(&data).Error
+	return data, err
+}
+
+// UpdateSize 更新记录的大小
+func (r *FileRepository) UpdateSize(ctx context.Context, id int64, size int64) error {
+	return r.DB.WithContext(ctx).Model(&Blog_file{}).Where("id = ?", id).Update("size", size).Error
+}
+
+func (u *OssLoader) fileRepo() *FileRepository {
+	if u.FileRepo != nil {
+		return u.FileRepo
+	}
+	return defaultFileRepository
+}
+
+type ownerCtxKey struct{}
+
+// WithOwner 指定 ctx 内上传记录的 owner，优先于 pmodel.GetCommonHeader 中的 uid
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerCtxKey{}, owner)
+}
+
+func ownerFromCtx(ctx context.Context) string {
+	if owner, ok := ctx.Value(ownerCtxKey{}).(string); ok && owner != "" {
+		return owner
+	}
+	return pmodel.GetCommonHeader(ctx).Uid
+}
+
+// saveFile 上传成功后记录元数据，owner 为空时取 WithOwner 设置的 owner 或 pmodel.GetCommonHeader 中的 uid
+// 没有配置仓库时直接返回；配置了 Quota 时新增记录才增加 owner 的用量，覆盖已有记录只计算大小的差值
+func (u *OssLoader) saveFile(ctx context.Context, data *Blog_file) (*Blog_file, error) {
+	if data == nil {
+		return data, nil
+	}
+	if data.Owner == "" {
+		data.Owner = ownerFromCtx(ctx)
+	}
+	repo := u.fileRepo()
+	if repo == nil {
+		u.Quota.addUsage(ctx, data.Owner, data.Size, 1)
+		return data, nil
+	}
+	if data.SaveType == "" {
+		data.SaveType = SaveTypeMinio
+	}
+	prev, err := repo.Save(ctx, data)
+	if err != nil {
+		return data, err
+	}
+	if prev != nil {
+		u.Quota.addUsage(ctx, data.Owner, data.Size-prev.Size, 0)
+	} else {
+		u.Quota.addUsage(ctx, data.Owner, data.Size, 1)
+	}
+	return data, nil
+}
+
+// releaseObject 对象删除后软删除引用它的记录并扣减用量
+func (u *OssLoader) releaseObject(ctx context.Context, bucket string, key string) error {
+	repo := u.fileRepo()
+	if repo == nil {
+		return nil
+	}
+	records, err := repo.QueryByObject(ctx, bucket, key)
+	if err != nil {
+		return errors.WithMessage(err, "release object query fail")
+	}
+	for _, record := range records {
+		if err = u.SoftDeleteFile(ctx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SoftDeleteFile 软删除文件记录并扣减 owner 的用量，不会删除存储中的对象
+func (u *OssLoader) SoftDeleteFile(ctx context.Context, record *Blog_file) error {
+	if record == nil {
+		return fmt.Errorf("SoftDeleteFile record is nil")
+	}
+	if repo := u.fileRepo(); repo != nil {
+		if err := repo.SoftDelete(ctx, record.Url, record.Owner); err != nil {
+			return err
+		}
+	}
+	u.Quota.addUsage(ctx, record.Owner, -record.Size, -1)
+	return nil
+}
+
+func (u *OssLoader) queryFileByMd5(ctx context.Context, md5 string) ([]*Blog_file, error) {
+	repo := u.fileRepo()
+	if repo == nil {
+		return make([]*Blog_file, 0), nil
+	}
+	return repo.QueryByMd5(ctx, md5)
+}
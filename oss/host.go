@@ -0,0 +1,347 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/putils"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const DefaultHealthPath = "/minio/health/live"
+
+// HostSelector 维护主 host 和备用 host 的健康状态，按 region 和健康状态排序候选 host
+type HostSelector struct {
+	Secure     bool          // 健康检查是否使用 https
+	HealthPath string        // 默认 /minio/health/live
+	Timeout    time.Duration // 单次健康检查超时，默认 3s
+	Interval   time.Duration // Start 的检查间隔，默认 30s
+	Client     *http.Client
+
+	mu      sync.RWMutex
+	hosts   []string
+	down    map[string]time.Time // 不健康的 host 及标记时间
+	retryIn time.Duration        // 标记为不健康后多久允许重新尝试
+}
+
+func NewHostSelector(secure bool, hosts ...string) *HostSelector {
+	return &HostSelector{
+		Secure:     secure,
+		HealthPath: DefaultHealthPath,
+		Timeout:    3 * time.Second,
+		Interval:   30 * time.Second,
+		hosts:      hosts,
+		down:       map[string]time.Time{},
+		retryIn:    time.Minute,
+	}
+}
+
+// AddHosts 增加需要定期检查的 host，只有加入的 host 才会被访问，Object 中其他的 Host/SubHosts 会被忽略
+func (s *HostSelector) AddHosts(hosts ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range hosts {
+		if h != "" && !containsStr(s.hosts, h) {
+			s.hosts = append(s.hosts, h)
+		}
+	}
+}
+
+// IsRegistered host 是否通过 NewHostSelector 或 AddHosts 加入
+func (s *HostSelector) IsRegistered(host string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return containsStr(s.hosts, host)
+}
+
+func containsStr(list []string, v string) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkFailed 请求 host 失败时调用，在 retryIn 内排到候选列表最后
+func (s *HostSelector) MarkFailed(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down == nil {
+		s.down = map[string]time.Time{}
+	}
+	s.down[host] = time.Now()
+}
+
+func (s *HostSelector) MarkHealthy(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.down, host)
+}
+
+func (s *HostSelector) IsHealthy(host string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.down[host]
+	if !ok {
+		return true
+	}
+	retryIn := s.retryIn
+	if retryIn <= 0 {
+		retryIn = time.Minute
+	}
+	return time.Since(t) > retryIn
+}
+
+// Check 并发检查所有 host 的健康状态
+func (s *HostSelector) Check(ctx context.Context) {
+	s.mu.RLock()
+	hosts := append([]string{}, s.hosts...)
+	s.mu.RUnlock()
+	wg := &sync.WaitGroup{}
+	for _, h := range hosts {
+		host := h
+		wg.Add(1)
+		go putils.GoFuncDone(ctx, wg, nil, func(ctx context.Context, param interface{}) {
+			if err := s.probe(ctx, host); err != nil {
+				logs.CtxWarnf(ctx, "HostSelector host %v unhealthy %v", host, err)
+				s.MarkFailed(host)
+				return
+			}
+			s.MarkHealthy(host)
+		})
+	}
+	wg.Wait()
+}
+
+func (s *HostSelector) probe(ctx context.Context, host string) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	scheme := "http"
+	if s.Secure {
+		scheme = "https"
+	}
+	healthPath := s.HealthPath
+	if healthPath == "" {
+		healthPath = DefaultHealthPath
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v://%v%v", scheme, host, healthPath), nil)
+	if err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// Start 在后台按 Interval 定期执行 Check，ctx 结束时退出
+func (s *HostSelector) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.Check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// HostCandidate 候选 host 及其 region
+type HostCandidate struct {
+	Host   string
+	Region string
+}
+
+// ObjectHosts Object 的主 host 和备用 host，SubRegion[i] 为 SubHosts[i] 所在 region
+func ObjectHosts(o *Object) []HostCandidate {
+	res := make([]HostCandidate, 0, len(o.SubHosts)+1)
+	if o.Host != "" {
+		res = append(res, HostCandidate{Host: o.Host, Region: o.Region})
+	}
+	for i, h := range o.SubHosts {
+		if h == "" {
+			continue
+		}
+		c := HostCandidate{Host: h}
+		if i < len(o.SubRegion) {
+			c.Region = o.SubRegion[i]
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// Order 排序候选 host：健康且与 region 相同的优先，其次是其他健康的，不健康的放最后作为兜底，同组内保持原顺序
+func (s *HostSelector) Order(candidates []HostCandidate, region string) []HostCandidate {
+	groups := make([][]HostCandidate, 3)
+	for _, c := range candidates {
+		switch {
+		case !s.IsHealthy(c.Host):
+			groups[2] = append(groups[2], c)
+		case region != "" && c.Region == region:
+			groups[0] = append(groups[0], c)
+		default:
+			groups[1] = append(groups[1], c)
+		}
+	}
+	res := make([]HostCandidate, 0, len(candidates))
+	for _, g := range groups {
+		res = append(res, g...)
+	}
+	return res
+}
+
+// WithHosts 配置 host 选择，Object 带有 Host/SubHosts 时按健康状态和 region 选择，请求失败自动切换
+func WithHosts(s *HostSelector) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Hosts = s
+	}
+}
+
+var ErrHostNotAllowed = errors.New("host not registered")
+
+// allowedHosts Object 的 Host/SubHosts 中 Endpoint 和 HostSelector 已登记的 host，Object 的内容可能来自客户端，不能直接访问其中的 host
+func (u *OssLoader) allowedHosts(o *Object) []HostCandidate {
+	if u.Hosts == nil {
+		return nil
+	}
+	candidates := ObjectHosts(o)
+	res := candidates[:0]
+	for _, c := range candidates {
+		if c.Host == u.Endpoint || u.Hosts.IsRegistered(c.Host) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// clientFor 返回访问 host 的客户端，host 为 Endpoint 时返回共享客户端，其他 host 必须已在 HostSelector 中登记
+func (u *OssLoader) clientFor(host string, region string) (*minio.Client, error) {
+	if host == "" || host == u.Endpoint {
+		return u.GetClient()
+	}
+	if u.Hosts == nil || !u.Hosts.IsRegistered(host) {
+		return nil, errors.WithMessage(ErrHostNotAllowed, host)
+	}
+	key := host + "|" + region
+	u.clientMu.Lock()
+	defer u.clientMu.Unlock()
+	if c, ok := u.hostClients[key]; ok {
+		return c, nil
+	}
+	if region == "" {
+		region = u.Region
+	}
+	c, err := u.newMinioClientFor(host, region)
+	if err != nil {
+		return nil, err
+	}
+	if u.hostClients == nil {
+		u.hostClients = map[string]*minio.Client{}
+	}
+	u.hostClients[key] = c
+	return c, nil
+}
+
+// DoWithFailover 按 HostSelector 排好的顺序依次用各 host 的客户端执行 fn，失败的 host 会被标记并切换到下一个
+// Object 没有已登记的 Host/SubHosts 或未配置 HostSelector 时只使用 Endpoint
+func (u *OssLoader) DoWithFailover(ctx context.Context, o *Object, region string, fn func(client *minio.Client, host string) error) error {
+	candidates := u.allowedHosts(o)
+	if len(candidates) == 0 {
+		client, err := u.GetClient()
+		if err != nil {
+			return err
+		}
+		return fn(client, u.Endpoint)
+	}
+	var lastErr error
+	for _, c := range u.Hosts.Order(candidates, region) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		client, err := u.clientFor(c.Host, c.Region)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err = fn(client, c.Host); err != nil {
+			if isObjectNotFound(err) {
+				return err
+			}
+			logs.CtxWarnf(ctx, "DoWithFailover host %v fail %v", c.Host, err)
+			u.Hosts.MarkFailed(c.Host)
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// isObjectNotFound 对象不存在等业务错误不需要切换 host
+func isObjectNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.Code == "NoSuchBucket" || resp.Code == "AccessDenied"
+}
+
+// SelectHost 返回 Object 已登记的 host 中当前最合适的，没有可选 host 时返回 OssLoader.Host
+func (u *OssLoader) SelectHost(o *Object, region string) string {
+	candidates := u.allowedHosts(o)
+	if len(candidates) > 0 {
+		candidates = u.Hosts.Order(candidates, region)
+	}
+	if len(candidates) > 0 {
+		return candidates[0].Host
+	}
+	return u.Host
+}
+
+// DownLoadObject 下载 Object，主 host 不可用时切换到备用 host，加密的对象返回解密后的内容
+func (u *OssLoader) DownLoadObject(ctx context.Context, o *Object, region string) (ObjectReader, error) {
+	var object *minio.Object
+	var stat minio.ObjectInfo
+	err := u.DoWithFailover(ctx, o, region, func(client *minio.Client, host string) error {
+		obj, err := client.GetObject(ctx, o.Bucket, o.Object, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		// GetObject 不会发起请求，需要 Stat 确认 host 可用
+		if stat, err = obj.Stat(); err != nil {
+			obj.Close()
+			return err
+		}
+		object = obj
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.openObject(object, stat)
+}
@@ -0,0 +1,458 @@
+package oss
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path"
+	"strings"
+
+	"github.com/EICHI-X/ptools/putils"
+	"github.com/minio/minio-go/v7"
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	ImageFormatJpeg = "jpeg"
+	ImageFormatPng  = "png"
+
+	DefaultJpegQuality = 85
+	minJpegQuality     = 40
+)
+
+// MaxImagePixels 解码前按文件头检查宽*高，超过时返回 ErrImageTooLarge，避免解码超大图片耗尽内存
+var MaxImagePixels = 50_000_000
+
+var ErrImageTooLarge = errors.New("image too large")
+
+// ImageVariant 额外生成的图片尺寸，保存为 VariantKey(原对象名, Name)
+type ImageVariant struct {
+	Name      string `json:"name"`
+	MaxWidth  int    `json:"max_width"`
+	MaxHeight int    `json:"max_height"`
+	Quality   int    `json:"quality"` // jpeg 质量，0 表示沿用 ImageOption.Quality
+}
+
+var DefaultImageVariants = []ImageVariant{
+	{Name: "thumb", MaxWidth: 200, MaxHeight: 200, Quality: 80},
+	{Name: "medium", MaxWidth: 800, MaxHeight: 800},
+	{Name: "large", MaxWidth: 1600, MaxHeight: 1600},
+}
+
+// ImageOption 图片处理参数，重新编码后会去掉 EXIF 等元数据
+type ImageOption struct {
+	MaxWidth   int    // 最大宽度，0 表示不限制，只缩小不放大
+	MaxHeight  int    // 最大高度，0 表示不限制
+	Quality    int    // jpeg 质量 1-100，默认 DefaultJpegQuality
+	MaxBytes   int64  // 编码后的最大字节数，超出时先降低质量再缩小尺寸，0 表示不限制
+	Format     string // 输出格式 jpeg/png，为空时透明图用 png，其余用 jpeg
+	AutoOrient bool   // 按 EXIF Orientation 旋转
+	Variants   []ImageVariant
+}
+
+func DefaultImageOption() ImageOption {
+	return ImageOption{
+		MaxWidth:   2560,
+		MaxHeight:  2560,
+		Quality:    DefaultJpegQuality,
+		AutoOrient: true,
+	}
+}
+
+// ProcessedImage 处理后的图片
+type ProcessedImage struct {
+	Data        []byte
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// VariantKey 生成变体的对象名，如 a/b.jpg + thumb => a/b_thumb.jpg
+func VariantKey(object string, name string, format string) string {
+	ext := path.Ext(object)
+	base := strings.TrimSuffix(object, ext)
+	if format != "" {
+		ext = "." + imageExt(format)
+	}
+	return base + "_" + name + ext
+}
+
+func imageExt(format string) string {
+	if format == ImageFormatJpeg {
+		return "jpg"
+	}
+	return format
+}
+
+// ReplaceImageExt 把扩展名改为与 format 一致，如 a/b.png + jpeg => a/b.jpg，.jpeg 和 .jpg 视为一致
+func ReplaceImageExt(name string, format string) string {
+	if format == "" {
+		return name
+	}
+	ext := path.Ext(name)
+	want := "." + imageExt(format)
+	if strings.EqualFold(ext, want) || (format == ImageFormatJpeg && strings.EqualFold(ext, ".jpeg")) {
+		return name
+	}
+	return strings.TrimSuffix(name, ext) + want
+}
+
+// DecodeImage 解码 jpeg/png/gif/webp，gif 只取第一帧，AutoOrient 时按 EXIF 旋转
+// 解码前先读文件头检查尺寸，宽*高超过 MaxImagePixels 时返回 ErrImageTooLarge
+func DecodeImage(r io.Reader, autoOrient bool) (image.Image, string, error) {
+	// EXIF 在 jpeg 头部 APP1 段，最大 64K
+	br := bufio.NewReaderSize(r, 64<<10+4)
+	orientation := 1
+	if autoOrient {
+		head, _ := br.Peek(64<<10 + 4)
+		orientation = exifOrientation(head)
+	}
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(br, &head))
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "decode image config fail")
+	}
+	if err = CheckImageSize(cfg.Width, cfg.Height); err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(io.MultiReader(&head, br))
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "decode image fail")
+	}
+	return applyOrientation(img, orientation), format, nil
+}
+
+// CheckImageSize 检查宽*高是否超过 MaxImagePixels
+func CheckImageSize(width int, height int) error {
+	if width <= 0 || height <= 0 {
+		return errors.WithMessage(ErrImageTooLarge, fmt.Sprintf("invalid size %vx%v", width, height))
+	}
+	if int64(width)*int64(height) > int64(MaxImagePixels) {
+		return errors.WithMessage(ErrImageTooLarge, fmt.Sprintf("size %vx%v more than %v pixels", width, height, MaxImagePixels))
+	}
+	return nil
+}
+
+// ProcessImage 解码、旋转、缩放并重新编码
+func ProcessImage(r io.Reader, opt ImageOption) (*ProcessedImage, image.Image, error) {
+	img, srcFormat, err := DecodeImage(r, opt.AutoOrient)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := outputFormat(opt.Format, srcFormat, img)
+	res, err := EncodeImage(img, format, opt.MaxWidth, opt.MaxHeight, opt.Quality, opt.MaxBytes)
+	return res, img, err
+}
+
+func outputFormat(format string, srcFormat string, img image.Image) string {
+	if format == ImageFormatJpeg || format == ImageFormatPng {
+		return format
+	}
+	if srcFormat == ImageFormatPng || srcFormat == "gif" || srcFormat == "webp" {
+		if !isOpaque(img) {
+			return ImageFormatPng
+		}
+	}
+	return ImageFormatJpeg
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// EncodeImage 缩放到 maxWidth*maxHeight 以内再编码，maxBytes>0 时逐步降低质量和尺寸直到满足
+func EncodeImage(img image.Image, format string, maxWidth int, maxHeight int, quality int, maxBytes int64) (*ProcessedImage, error) {
+	if quality <= 0 || quality > 100 {
+		quality = DefaultJpegQuality
+	}
+	img = fitImage(img, maxWidth, maxHeight)
+	for i := 0; ; i++ {
+		var buf bytes.Buffer
+		var err error
+		switch format {
+		case ImageFormatPng:
+			err = png.Encode(&buf, img)
+		default:
+			format = ImageFormatJpeg
+			err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+		}
+		if err != nil {
+			return nil, err
+		}
+		size := int64(buf.Len())
+		if maxBytes <= 0 || size <= maxBytes || i >= 10 {
+			b := img.Bounds()
+			return &ProcessedImage{
+				Data:        buf.Bytes(),
+				Format:      format,
+				ContentType: "image/" + format,
+				Width:       b.Dx(),
+				Height:      b.Dy(),
+			}, nil
+		}
+		if format == ImageFormatJpeg && quality > minJpegQuality {
+			quality = putils.MaxInt(minJpegQuality, quality-10)
+			continue
+		}
+		// 字节数大致与像素数成正比，按面积比例缩小边长
+		rate := math.Sqrt(float64(maxBytes)/float64(size)) * 0.9
+		b := img.Bounds()
+		w := uint(math.Max(1, float64(b.Dx())*rate))
+		h := uint(math.Max(1, float64(b.Dy())*rate))
+		img = resize.Resize(w, h, img, resize.Lanczos3)
+	}
+}
+
+func fitImage(img image.Image, maxWidth int, maxHeight int) image.Image {
+	b := img.Bounds()
+	if (maxWidth <= 0 || b.Dx() <= maxWidth) && (maxHeight <= 0 || b.Dy() <= maxHeight) {
+		return img
+	}
+	if maxWidth <= 0 {
+		maxWidth = b.Dx()
+	}
+	if maxHeight <= 0 {
+		maxHeight = b.Dy()
+	}
+	return resize.Thumbnail(uint(maxWidth), uint(maxHeight), img, resize.Lanczos3)
+}
+
+// flatten 透明背景转为白色，jpeg 不支持透明
+func flatten(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// exifOrientation 从 jpeg 头部解析 EXIF Orientation，解析不到时返回 1
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// SOS 之后是图像数据，不会再有 APP1
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		start, end := i+4, i+2+segLen
+		if segLen < 2 || end > len(data) {
+			return 1
+		}
+		if marker == 0xE1 && end-start > 6 && string(data[start:start+6]) == "Exif\x00\x00" {
+			return tiffOrientation(data[start+6 : end])
+		}
+		i = end
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			v := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation 按 EXIF Orientation 的 8 种取值变换图片
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// 5-8 需要交换宽高
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// ImageUploadResult 原图和各个变体的上传结果
+type ImageUploadResult struct {
+	Original *minio.UploadInfo
+	Image    *ProcessedImage
+	Variants map[string]string // 变体名 => 对象名
+	File     *Blog_file
+}
+
+// UploadImage 按 opt 处理图片后上传，同时生成并上传 opt.Variants，变体对象名记录在原图的元数据中
+// 输出格式与 object、filename 的扩展名不一致时改为对应的扩展名，实际对象名见 Original.Key
+func (u *OssLoader) UploadImage(ctx context.Context, bucket string, object string, file io.Reader, filename string, opt ImageOption) (*ImageUploadResult, error) {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	processed, img, err := ProcessImage(file, opt)
+	if err != nil {
+		return nil, err
+	}
+	object = ReplaceImageExt(object, processed.Format)
+	res := &ImageUploadResult{
+		Image:    processed,
+		Variants: make(map[string]string, len(opt.Variants)),
+	}
+	size := int64(len(processed.Data))
+	for _, v := range opt.Variants {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		quality := v.Quality
+		if quality <= 0 {
+			quality = opt.Quality
+		}
+		variant, err := EncodeImage(img, processed.Format, v.MaxWidth, v.MaxHeight, quality, 0)
+		if err != nil {
+			return nil, err
+		}
+		key := VariantKey(object, v.Name, variant.Format)
+		_, err = minioClient.PutObject(ctx, bucket, key, bytes.NewReader(variant.Data), int64(len(variant.Data)), minio.PutObjectOptions{ContentType: variant.ContentType})
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("upload variant %v fail", v.Name))
+		}
+		res.Variants[v.Name] = key
+		size += int64(len(variant.Data))
+	}
+	putOption := minio.PutObjectOptions{ContentType: processed.ContentType}
+	if len(res.Variants) > 0 {
+		putOption.UserMetadata = map[string]string{"variants": putils.ToJson(res.Variants)}
+	}
+	info, err := minioClient.PutObject(ctx, bucket, object, bytes.NewReader(processed.Data), int64(len(processed.Data)), putOption)
+	if err != nil {
+		return nil, errors.WithMessage(err, "upload image fail")
+	}
+	res.Original = &info
+	if filename == "" {
+		filename = path.Base(object)
+	}
+	filename = ReplaceImageExt(filename, processed.Format)
+	record := &Blog_file{
+		Filename:    filename,
+		ContentType: processed.ContentType,
+		Url:         u.objectRef(bucket, object),
+		Path:        object,
+		Bucket:      bucket,
+		Md5:         strings.Trim(info.ETag, "\""),
+		Prefix:      u.Prefix,
+		MinioKey:    object,
+		SaveType:    SaveTypeMinio,
+		Size:        size,
+	}
+	if len(res.Variants) > 0 {
+		record.Variants = putils.ToJson(res.Variants)
+	}
+	if res.File, err = u.saveFile(ctx, record); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+const (
+	FitContain = "contain" // 等比缩放到框内
+	FitCover   = "cover"   // 等比缩放铺满框后居中裁剪
+	FitFill    = "fill"    // 拉伸到指定宽高
+)
+
+// ResizeImage 按 fit 方式缩放到 width*height，width 或 height 为 0 时按另一边等比缩放
+func ResizeImage(img image.Image, width int, height int, fit string) image.Image {
+	b := img.Bounds()
+	if width <= 0 && height <= 0 {
+		return img
+	}
+	if width <= 0 || height <= 0 {
+		return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+	}
+	switch fit {
+	case FitFill:
+		return resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+	case FitCover:
+		rate := math.Max(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+		w := int(math.Ceil(float64(b.Dx()) * rate))
+		h := int(math.Ceil(float64(b.Dy()) * rate))
+		scaled := resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+		sb := scaled.Bounds()
+		x0 := sb.Min.X + (sb.Dx()-width)/2
+		y0 := sb.Min.Y + (sb.Dy()-height)/2
+		dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(dst, dst.Bounds(), scaled, image.Point{X: x0, Y: y0}, draw.Src)
+		return dst
+	default:
+		return fitImage(img, width, height)
+	}
+}
@@ -0,0 +1,106 @@
+package oss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// testExifJpeg 在 jpeg 的 SOI 之后插入只有 Orientation 的 EXIF APP1 段
+func testExifJpeg(t *testing.T, img image.Image, orientation uint16, order binary.ByteOrder) []byte {
+	res, err := EncodeImage(img, ImageFormatJpeg, 0, 0, 90, 0)
+	assert.Nil(t, err)
+	tiff := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+	binary.Write(tiff, order, uint16(1))
+	binary.Write(tiff, order, []uint16{0x0112, 3})
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, []uint16{orientation, 0})
+	binary.Write(tiff, order, uint32(0))
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, res.Data[2:]...)
+}
+
+func testImage(w int, h int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 10), G: uint8(y * 10), B: 100, A: alpha})
+		}
+	}
+	return img
+}
+
+func TestExifOrientation(t *testing.T) {
+	img := testImage(4, 2, 255)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := uint16(1); o <= 8; o++ {
+			assert.Equal(t, int(o), exifOrientation(testExifJpeg(t, img, o, order)))
+		}
+	}
+	// 非法取值、截断和非 jpeg 都按 1 处理
+	data := testExifJpeg(t, img, 9, binary.BigEndian)
+	assert.Equal(t, 1, exifOrientation(data))
+	assert.Equal(t, 1, exifOrientation(testExifJpeg(t, img, 6, binary.BigEndian)[:20]))
+	assert.Equal(t, 1, exifOrientation([]byte("GIF89a")))
+	assert.Equal(t, 1, exifOrientation(nil))
+
+	// 6 表示顺时针旋转 90 度，解码后宽高互换
+	decoded, format, err := DecodeImage(bytes.NewReader(testExifJpeg(t, img, 6, binary.LittleEndian)), true)
+	assert.Nil(t, err)
+	assert.Equal(t, ImageFormatJpeg, format)
+	assert.Equal(t, image.Rect(0, 0, 2, 4), decoded.Bounds())
+	decoded, _, err = DecodeImage(bytes.NewReader(testExifJpeg(t, img, 6, binary.LittleEndian)), false)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 4, 2), decoded.Bounds())
+}
+
+func TestProcessImage(t *testing.T) {
+	// 不透明的 png 转为 jpeg，重新编码后不带 EXIF
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, testImage(40, 20, 255)))
+	res, _, err := ProcessImage(bytes.NewReader(buf.Bytes()), ImageOption{MaxWidth: 10, AutoOrient: true})
+	assert.Nil(t, err)
+	assert.Equal(t, ImageFormatJpeg, res.Format)
+	assert.Equal(t, "image/jpeg", res.ContentType)
+	assert.Equal(t, 10, res.Width)
+	assert.Equal(t, 5, res.Height)
+	assert.Equal(t, "a/b.jpg", ReplaceImageExt("a/b.png", res.Format))
+
+	res, _, err = ProcessImage(bytes.NewReader(testExifJpeg(t, testImage(4, 2, 255), 6, binary.BigEndian)), DefaultImageOption())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, exifOrientation(res.Data))
+	assert.Equal(t, 2, res.Width)
+
+	// 透明图保留 png
+	buf.Reset()
+	assert.Nil(t, png.Encode(&buf, testImage(8, 8, 100)))
+	res, _, err = ProcessImage(bytes.NewReader(buf.Bytes()), DefaultImageOption())
+	assert.Nil(t, err)
+	assert.Equal(t, ImageFormatPng, res.Format)
+	assert.Equal(t, "b.png", ReplaceImageExt("b.png", res.Format))
+	assert.Equal(t, "b.jpeg", ReplaceImageExt("b.jpeg", ImageFormatJpeg))
+
+	// 超过像素上限时不解码
+	old := MaxImagePixels
+	MaxImagePixels = 63
+	defer func() { MaxImagePixels = old }()
+	_, _, err = ProcessImage(bytes.NewReader(buf.Bytes()), DefaultImageOption())
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+}
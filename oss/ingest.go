@@ -0,0 +1,310 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/purl"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultIngestMaxBytes     = 20 << 20
+	DefaultIngestTimeout      = 30 * time.Second
+	DefaultIngestMaxRedirects = 3
+)
+
+var (
+	ErrIngestUrlNotAllowed     = errors.New("remote url not allowed")
+	ErrIngestAddressNotAllowed = errors.New("remote address not allowed")
+	ErrIngestTooLarge          = errors.New("remote file too large")
+	ErrIngestTooManyRedirects  = errors.New("remote url too many redirects")
+)
+
+// 除 net.IP 自带的判断外需要拦截的网段
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",       // 本网络
+	"100.64.0.0/10",   // 运营商 NAT
+	"192.0.0.0/24",    // IETF 保留
+	"192.0.2.0/24",    // 文档
+	"198.18.0.0/15",   // 基准测试
+	"198.51.100.0/24", // 文档
+	"203.0.113.0/24",  // 文档
+	"240.0.0.0/4",     // 保留，包括广播地址
+	"64:ff9b::/96",    // NAT64，可映射到内网 ipv4
+	"2001:db8::/32",   // 文档
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// IsPublicIP 是否是公网地址，内网、回环、链路本地、组播和保留地址都返回 false
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// SafeHttpClientOption 抓取外部地址的 http 客户端参数
+type SafeHttpClientOption struct {
+	Timeout      time.Duration // 整个请求的超时时间，包括读取 body，默认 DefaultIngestTimeout
+	MaxRedirects int           // 默认 DefaultIngestMaxRedirects，小于 0 表示不跟随跳转
+	AllowedPorts []int         // 默认 80、443
+}
+
+func (opt SafeHttpClientOption) allowedPorts() []int {
+	if len(opt.AllowedPorts) == 0 {
+		return []int{80, 443}
+	}
+	return opt.AllowedPorts
+}
+
+// checkUrl 只允许 http/https 和指定端口，拒绝带账号密码的地址
+func (opt SafeHttpClientOption) checkUrl(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.WithMessage(ErrIngestUrlNotAllowed, "scheme "+u.Scheme)
+	}
+	if u.User != nil || u.Hostname() == "" {
+		return errors.WithMessage(ErrIngestUrlNotAllowed, u.Redacted())
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !containsInt(opt.allowedPorts(), p) {
+		return errors.WithMessage(ErrIngestUrlNotAllowed, "port "+port)
+	}
+	return nil
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSafeHttpClient 抓取用户提供地址的 http 客户端
+// 在建立连接时检查实际连接的 ip，域名解析到内网地址或 DNS rebinding 都会被拒绝；不使用环境变量中的代理
+func NewSafeHttpClient(opt SafeHttpClientOption) *http.Client {
+	timeout := opt.Timeout
+	if timeout <= 0 {
+		timeout = DefaultIngestTimeout
+	}
+	maxRedirects := opt.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultIngestMaxRedirects
+	}
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !IsPublicIP(net.ParseIP(host)) {
+				return errors.WithMessage(ErrIngestAddressNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects < 0 || len(via) > maxRedirects {
+				return ErrIngestTooManyRedirects
+			}
+			return opt.checkUrl(req.URL)
+		},
+	}
+}
+
+// RemoteIngester 抓取外部地址的文件并转存到 bucket，用于文章中粘贴的外链图片
+type RemoteIngester struct {
+	Loader       *OssLoader
+	Bucket       string
+	KeyPrefix    string       // 未配置 Validator 时对象名为 KeyPrefix + 日期/uuid + 扩展名
+	IsPublic     bool         // bucket 是否公开，公开时返回 CDN 或 https 地址，否则返回 EncodeRef 编码的引用
+	MaxBytes     int64        // 默认 DefaultIngestMaxBytes
+	ContentTypes []string     // 按文件头识别的类型白名单，支持 image/*，默认只允许图片
+	Image        *ImageOption // 不为空时图片按该配置压缩并生成变体
+	UserAgent    string
+	Client       *http.Client // 为空时使用 NewSafeHttpClient(HttpOption)
+	HttpOption   SafeHttpClientOption
+
+	clientOnce sync.Once
+}
+
+func NewRemoteIngester(loader *OssLoader, bucket string) *RemoteIngester {
+	return &RemoteIngester{
+		Loader:       loader,
+		Bucket:       bucket,
+		MaxBytes:     DefaultIngestMaxBytes,
+		ContentTypes: []string{"image/*"},
+	}
+}
+
+func (r *RemoteIngester) client() *http.Client {
+	r.clientOnce.Do(func() {
+		if r.Client == nil {
+			r.Client = NewSafeHttpClient(r.HttpOption)
+		}
+	})
+	return r.Client
+}
+
+// Ingest 抓取 rawUrl 并上传，返回的 FileInfo 与上传接口一致
+func (r *RemoteIngester) Ingest(ctx context.Context, rawUrl string) (*purl.FileInfo, error) {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return nil, errors.WithMessage(ErrIngestUrlNotAllowed, err.Error())
+	}
+	if err := r.HttpOption.checkUrl(u); err != nil {
+		return nil, err
+	}
+	maxBytes := r.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultIngestMaxBytes
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return nil, errors.WithMessage(err, "fetch remote url fail")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch remote url status %v", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, errors.WithMessage(ErrIngestTooLarge, fmt.Sprintf("size %v more than %v", resp.ContentLength, maxBytes))
+	}
+	if err := r.Loader.CheckQuota(ctx, "", resp.ContentLength); err != nil {
+		return nil, err
+	}
+
+	// 不信任响应头的 Content-Type，按文件头识别
+	contentType, body, err := SniffContentType(resp.Body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read remote url fail")
+	}
+	if !contentTypeAllowed(r.ContentTypes, contentType) {
+		return nil, errors.WithMessage(ErrUploadTypeNotAllowed, contentType)
+	}
+	// 长度未知时读入内存，已知时按长度流式上传，都不超过 maxBytes
+	size := resp.ContentLength
+	if size < 0 {
+		data, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+		if err != nil {
+			return nil, errors.WithMessage(err, "read remote url fail")
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, errors.WithMessage(ErrIngestTooLarge, fmt.Sprintf("size more than %v", maxBytes))
+		}
+		size = int64(len(data))
+		body = bytes.NewReader(data)
+	} else {
+		body = io.LimitReader(body, size)
+	}
+
+	filename := SanitizeFilename(path.Base(u.Path))
+	if ext := ingestExt(contentType); ext != "" && !strings.EqualFold(path.Ext(filename), ext) {
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + ext
+	}
+	info, err := r.upload(ctx, body, filename, size)
+	if err != nil {
+		return nil, err
+	}
+	logs.CtxInfof(ctx, "RemoteIngester ingest %v => %v", u.Redacted(), info.FilePath)
+	return info, nil
+}
+
+func (r *RemoteIngester) upload(ctx context.Context, reader io.Reader, filename string, size int64) (*purl.FileInfo, error) {
+	return r.Loader.storeUpload(ctx, &storeTarget{
+		Bucket:    r.Bucket,
+		KeyPrefix: r.KeyPrefix,
+		IsPublic:  r.IsPublic,
+		Image:     r.Image,
+		DefaultRule: &UploadRule{
+			ContentTypes:  r.ContentTypes,
+			KeyPrefix:     r.KeyPrefix,
+			RandomizeName: true,
+		},
+	}, reader, filename, size)
+}
+
+// ingestExt 按识别出的类型确定扩展名，避免外链地址没有扩展名或扩展名与内容不符
+func ingestExt(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/bmp":
+		return ".bmp"
+	case "application/pdf":
+		return ".pdf"
+	}
+	return ""
+}
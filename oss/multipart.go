@@ -0,0 +1,457 @@
+package oss
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/putils"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	MinPartSize     = 5 << 20 // s3 要求除最后一片外每片至少 5M
+	DefaultPartSize = 16 << 20
+	MaxPartsCount   = 10000
+)
+
+// ProgressFunc 上传进度回调，total 未知时为 0
+type ProgressFunc func(uploaded int64, total int64)
+
+// UploadedPart 已上传的分片，Md5 为本地计算的分片 md5 hex
+type UploadedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	Md5        string `json:"md5"`
+}
+
+// MultipartSession 一次可断点续传的分片上传，UploadID 需要由调用方保存，用于重启后 Resume
+// 从 JSON 解析得到的 session 没有关联 OssLoader，需要先调用 OssLoader.ResumeMultipartUpload 或 Attach，否则各方法返回 ErrSessionDetached
+type MultipartSession struct {
+	Bucket    string       `json:"bucket"`
+	Object    string       `json:"object"`
+	UploadID  string       `json:"upload_id"`
+	Size      int64        `json:"size"`      // 文件总大小，未知时为 0
+	PartSize  int64        `json:"part_size"` // 分片大小
+	CreatedAt time.Time    `json:"created_at"`
+	Owner     string       `json:"owner,omitempty"` // 创建时的 owner，合并时按它检查配额和记录元数据
+	Progress  ProgressFunc `json:"-"`
+
+	loader   *OssLoader
+	uploaded int64
+}
+
+var ErrSessionDetached = errors.New("multipart session not attached to loader")
+
+// Attach 关联 OssLoader，不查询已上传的分片，需要恢复进度时使用 OssLoader.ResumeMultipartUpload
+func (s *MultipartSession) Attach(u *OssLoader) *MultipartSession {
+	s.loader = u
+	return s
+}
+
+func (s *MultipartSession) core() (*minio.Core, error) {
+	if s.loader == nil {
+		return nil, ErrSessionDetached
+	}
+	return s.loader.core()
+}
+
+// PartCount 按 Size 和 PartSize 计算总分片数，Size 未知时返回 0
+func (s *MultipartSession) PartCount() int {
+	if s.Size <= 0 || s.PartSize <= 0 {
+		return 0
+	}
+	return int((s.Size + s.PartSize - 1) / s.PartSize)
+}
+
+// PartRange 返回第 partNumber 片(从 1 开始)在文件中的偏移和长度
+func (s *MultipartSession) PartRange(partNumber int) (offset int64, size int64) {
+	offset = int64(partNumber-1) * s.PartSize
+	size = s.PartSize
+	if s.Size > 0 && offset+size > s.Size {
+		size = s.Size - offset
+	}
+	return offset, size
+}
+
+// Uploaded 已上传字节数
+func (s *MultipartSession) Uploaded() int64 {
+	return atomic.LoadInt64(&s.uploaded)
+}
+
+func (s *MultipartSession) addProgress(n int64) {
+	uploaded := atomic.AddInt64(&s.uploaded, n)
+	if s.Progress != nil {
+		s.Progress(uploaded, s.Size)
+	}
+}
+
+// partSizeFor 根据文件大小调整分片大小，保证不超过 MaxPartsCount
+func partSizeFor(size int64, partSize int64) int64 {
+	if partSize < MinPartSize {
+		partSize = DefaultPartSize
+	}
+	for size > 0 && (size+partSize-1)/partSize > MaxPartsCount {
+		partSize *= 2
+	}
+	return partSize
+}
+
+func (u *OssLoader) core() (*minio.Core, error) {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	return &minio.Core{Client: minioClient}, nil
+}
+
+// InitiateMultipartUpload 创建分片上传，partSize<=0 时使用 DefaultPartSize，size 已知时先按 owner 检查配额
+// owner 取 WithOwner 或 pmodel.GetCommonHeader 中的 uid，保存在 session 中，恢复上传时不需要再设置
+func (u *OssLoader) InitiateMultipartUpload(ctx context.Context, bucket string, object string, size int64, partSize int64, opts minio.PutObjectOptions) (*MultipartSession, error) {
+	owner := ownerFromCtx(ctx)
+	if err := u.CheckQuota(ctx, owner, size); err != nil {
+		return nil, err
+	}
+	core, err := u.core()
+	if err != nil {
+		return nil, err
+	}
+	uploadID, err := core.NewMultipartUpload(ctx, bucket, object, opts)
+	if err != nil {
+		return nil, errors.WithMessage(err, "InitiateMultipartUpload fail")
+	}
+	return &MultipartSession{
+		Bucket:    bucket,
+		Object:    object,
+		UploadID:  uploadID,
+		Size:      size,
+		PartSize:  partSizeFor(size, partSize),
+		CreatedAt: time.Now(),
+		Owner:     owner,
+		loader:    u,
+	}, nil
+}
+
+// ResumeMultipartUpload 恢复未完成的分片上传，已上传的字节数会计入进度
+func (u *OssLoader) ResumeMultipartUpload(ctx context.Context, session *MultipartSession) (*MultipartSession, error) {
+	if session == nil || session.UploadID == "" {
+		return nil, fmt.Errorf("ResumeMultipartUpload upload id is empty")
+	}
+	session.Attach(u)
+	if session.PartSize <= 0 {
+		session.PartSize = partSizeFor(session.Size, 0)
+	}
+	parts, err := session.ListParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var uploaded int64
+	for _, p := range parts {
+		uploaded += p.Size
+	}
+	atomic.StoreInt64(&session.uploaded, uploaded)
+	return session, nil
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.progress(int64(n))
+	}
+	return n, err
+}
+
+// UploadPart 上传一个分片，md5Base64 不为空时由存储端校验
+// 同时在本地边传边算 md5，与返回的 ETag 不一致时返回错误，调用方重传该分片即可
+func (s *MultipartSession) UploadPart(ctx context.Context, partNumber int, data io.Reader, size int64, md5Base64 string) (*UploadedPart, error) {
+	if partNumber < 1 || partNumber > MaxPartsCount {
+		return nil, fmt.Errorf("part number %v out of range", partNumber)
+	}
+	core, err := s.core()
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	var sent int64
+	reader := &progressReader{
+		r: io.TeeReader(data, h),
+		progress: func(n int64) {
+			sent += n
+			s.addProgress(n)
+		},
+	}
+	part, err := core.PutObjectPart(ctx, s.Bucket, s.Object, s.UploadID, partNumber, reader, size, minio.PutObjectPartOptions{Md5Base64: md5Base64})
+	if err != nil {
+		// 失败的分片不计入进度
+		s.addProgress(-sent)
+		return nil, errors.WithMessage(err, fmt.Sprintf("UploadPart %v fail", partNumber))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	etag := strings.Trim(part.ETag, "\"")
+	if len(etag) == 32 && !strings.EqualFold(etag, sum) {
+		s.addProgress(-sent)
+		return nil, fmt.Errorf("UploadPart %v checksum not match, local %v, etag %v", partNumber, sum, etag)
+	}
+	return &UploadedPart{
+		PartNumber: partNumber,
+		ETag:       part.ETag,
+		Size:       part.Size,
+		Md5:        sum,
+	}, nil
+}
+
+// ListParts 列出已上传的全部分片
+func (s *MultipartSession) ListParts(ctx context.Context) ([]minio.ObjectPart, error) {
+	core, err := s.core()
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]minio.ObjectPart, 0)
+	marker := 0
+	for {
+		res, err := core.ListObjectParts(ctx, s.Bucket, s.Object, s.UploadID, marker, 1000)
+		if err != nil {
+			return nil, errors.WithMessage(err, "ListParts fail")
+		}
+		parts = append(parts, res.ObjectParts...)
+		if !res.IsTruncated {
+			break
+		}
+		marker = res.NextPartNumberMarker
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// MissingParts 返回还未上传的分片号，需要 Size 已知
+func (s *MultipartSession) MissingParts(ctx context.Context) ([]int, error) {
+	total := s.PartCount()
+	if total == 0 {
+		return nil, fmt.Errorf("MissingParts size unknown")
+	}
+	parts, err := s.ListParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]int64, len(parts))
+	for _, p := range parts {
+		done[p.PartNumber] = p.Size
+	}
+	missing := make([]int, 0)
+	for i := 1; i <= total; i++ {
+		_, size := s.PartRange(i)
+		if uploadedSize, ok := done[i]; !ok || uploadedSize != size {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// Complete 按分片号合并已上传的分片，合并前按分片总大小检查 Owner 的配额，合并后记录元数据并增加用量
+// 超过配额时不合并并 Abort，已上传的分片会被清理
+func (s *MultipartSession) Complete(ctx context.Context, opts minio.PutObjectOptions) (*minio.UploadInfo, error) {
+	parts, err := s.ListParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("Complete no part uploaded")
+	}
+	if total := s.PartCount(); total > 0 && len(parts) != total {
+		return nil, fmt.Errorf("Complete parts not finish %v/%v", len(parts), total)
+	}
+	var size int64
+	for _, p := range parts {
+		size += p.Size
+	}
+	if err = s.loader.CheckQuota(ctx, s.Owner, size); err != nil {
+		if abortErr := s.Abort(context.WithoutCancel(ctx)); abortErr != nil {
+			logs.CtxWarnf(ctx, "Complete abort %v fail %v", s.UploadID, abortErr)
+		}
+		return nil, err
+	}
+	completeParts := make([]minio.CompletePart, len(parts))
+	for i, p := range parts {
+		completeParts[i] = minio.CompletePart{
+			PartNumber:     p.PartNumber,
+			ETag:           p.ETag,
+			ChecksumCRC32:  p.ChecksumCRC32,
+			ChecksumCRC32C: p.ChecksumCRC32C,
+			ChecksumSHA1:   p.ChecksumSHA1,
+			ChecksumSHA256: p.ChecksumSHA256,
+		}
+	}
+	core, err := s.core()
+	if err != nil {
+		return nil, err
+	}
+	info, err := core.CompleteMultipartUpload(ctx, s.Bucket, s.Object, s.UploadID, completeParts, opts)
+	if err != nil {
+		return nil, errors.WithMessage(err, "CompleteMultipartUpload fail")
+	}
+	if info.Size == 0 {
+		info.Size = size
+	}
+	_, err = s.loader.saveFile(ctx, &Blog_file{
+		Filename:    path.Base(s.Object),
+		ContentType: opts.ContentType,
+		Owner:       s.Owner,
+		Url:         s.loader.objectRef(s.Bucket, s.Object),
+		Path:        s.Object,
+		Bucket:      s.Bucket,
+		Md5:         etagMd5(info.ETag),
+		Prefix:      s.loader.Prefix,
+		MinioKey:    s.Object,
+		SaveType:    SaveTypeMinio,
+		Size:        info.Size,
+	})
+	return &info, err
+}
+
+// Abort 取消分片上传并清理已上传的分片
+func (s *MultipartSession) Abort(ctx context.Context) error {
+	core, err := s.core()
+	if err != nil {
+		return err
+	}
+	return core.AbortMultipartUpload(ctx, s.Bucket, s.Object, s.UploadID)
+}
+
+// UploadResumable 上传 file 中所有缺失的分片并合并，session 可以是新建或 Resume 得到的
+// concurrency<=0 时串行上传，单个分片失败最多重试 retryTime 次
+func (s *MultipartSession) UploadResumable(ctx context.Context, file io.ReaderAt, concurrency int, retryTime int, opts minio.PutObjectOptions) (*minio.UploadInfo, error) {
+	missing, err := s.MissingParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if retryTime <= 0 {
+		retryTime = 1
+	}
+	var firstErr error
+	var errOnce sync.Once
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for _, partNumber := range missing {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go putils.GoFuncDone(ctx, wg, partNumber, func(ctx context.Context, param interface{}) {
+			defer func() { <-sem }()
+			partNumber := param.(int)
+			offset, size := s.PartRange(partNumber)
+			var err error
+			for retry := 0; retry < retryTime; retry++ {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+					break
+				}
+				_, err = s.UploadPart(ctx, partNumber, io.NewSectionReader(file, offset, size), size, "")
+				if err == nil {
+					return
+				}
+				logs.CtxWarnf(ctx, "UploadResumable object=%v part=%v retry=%v err=%v", s.Object, partNumber, retry, err)
+			}
+			errOnce.Do(func() { firstErr = err })
+		})
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Complete(ctx, opts)
+}
+
+// MultipartJanitor 定期取消超过 MaxAge 仍未完成的分片上传，释放占用的存储
+type MultipartJanitor struct {
+	Loader   *OssLoader
+	Buckets  []string
+	Prefix   string
+	MaxAge   time.Duration
+	Interval time.Duration
+}
+
+// RunOnce 扫描一次，返回取消的上传数
+func (j *MultipartJanitor) RunOnce(ctx context.Context) (int, error) {
+	if j.MaxAge <= 0 {
+		return 0, fmt.Errorf("MultipartJanitor max age must be positive")
+	}
+	minioClient, err := j.Loader.GetClient()
+	if err != nil {
+		return 0, err
+	}
+	core := &minio.Core{Client: minioClient}
+	deadline := time.Now().Add(-j.MaxAge)
+	aborted := 0
+	for _, bucket := range j.Buckets {
+		for upload := range minioClient.ListIncompleteUploads(ctx, bucket, j.Prefix, true) {
+			if upload.Err != nil {
+				return aborted, upload.Err
+			}
+			if upload.Initiated.After(deadline) {
+				continue
+			}
+			if err := core.AbortMultipartUpload(ctx, bucket, upload.Key, upload.UploadID); err != nil {
+				logs.CtxWarnf(ctx, "MultipartJanitor abort bucket=%v object=%v upload=%v fail %v", bucket, upload.Key, upload.UploadID, err)
+				continue
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// Start 在后台按 Interval 定期执行 RunOnce，ctx 结束时退出
+func (j *MultipartJanitor) Start(ctx context.Context) {
+	interval := j.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			putils.GoFuncDone(ctx, wg, nil, func(ctx context.Context, param interface{}) {
+				n, err := j.RunOnce(ctx)
+				if err != nil {
+					logs.CtxErrorf(ctx, "MultipartJanitor run fail %v", err)
+				}
+				if n > 0 {
+					logs.CtxInfof(ctx, "MultipartJanitor aborted %v uploads", n)
+				}
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
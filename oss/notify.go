@@ -0,0 +1,407 @@
+package oss
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/paerospike"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+const (
+	EventObjectCreated = "s3:ObjectCreated:"
+	EventObjectRemoved = "s3:ObjectRemoved:"
+
+	DefaultEventDoneTtl = 7 * 24 * time.Hour
+)
+
+// EventHandler 处理一条对象事件，返回错误时按 EventSubscriber 的重试策略重试
+type EventHandler func(ctx context.Context, event notification.Event) error
+
+// EventStore 保存已处理事件和消费进度，保证重启后事件不丢、不重复处理
+type EventStore interface {
+	IsDone(ctx context.Context, key string) bool
+	MarkDone(ctx context.Context, key string) error
+	LoadCheckpoint(ctx context.Context, name string) (time.Time, error)
+	SaveCheckpoint(ctx context.Context, name string, t time.Time) error
+}
+
+// MemoryEventStore 进程内的 EventStore，重启后进度丢失，用于测试或单机
+type MemoryEventStore struct {
+	mu          sync.Mutex
+	done        map[string]bool
+	checkpoints map[string]time.Time
+}
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{done: map[string]bool{}, checkpoints: map[string]time.Time{}}
+}
+
+func (s *MemoryEventStore) IsDone(ctx context.Context, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[key]
+}
+
+func (s *MemoryEventStore) MarkDone(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[key] = true
+	return nil
+}
+
+func (s *MemoryEventStore) LoadCheckpoint(ctx context.Context, name string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *MemoryEventStore) SaveCheckpoint(ctx context.Context, name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[name] = t
+	return nil
+}
+
+// AerospikeEventStore 基于 aerospike 的 EventStore，已处理事件保留 DoneTtl
+type AerospikeEventStore struct {
+	Client        *paerospike.Client
+	DonePattern   string // 格式必须是 appid|project|key，默认 1000|oss|event_done.%v
+	CheckpointKey string // 默认 1000|oss|event_checkpoint.%v
+	DoneTtl       time.Duration
+}
+
+func NewAerospikeEventStore(psm string) *AerospikeEventStore {
+	return &AerospikeEventStore{
+		Client:        paerospike.NewDefaultClient(psm),
+		DonePattern:   "1000|oss|event_done.%v",
+		CheckpointKey: "1000|oss|event_checkpoint.%v",
+		DoneTtl:       DefaultEventDoneTtl,
+	}
+}
+
+func (s *AerospikeEventStore) IsDone(ctx context.Context, key string) bool {
+	v, _ := s.Client.Get(fmt.Sprintf(s.DonePattern, key))
+	return v != ""
+}
+
+func (s *AerospikeEventStore) MarkDone(ctx context.Context, key string) error {
+	return s.Client.Put(fmt.Sprintf(s.DonePattern, key), "1", uint32(s.DoneTtl/time.Second))
+}
+
+func (s *AerospikeEventStore) LoadCheckpoint(ctx context.Context, name string) (time.Time, error) {
+	v, _ := s.Client.Get(fmt.Sprintf(s.CheckpointKey, name))
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+func (s *AerospikeEventStore) SaveCheckpoint(ctx context.Context, name string, t time.Time) error {
+	return s.Client.Put(fmt.Sprintf(s.CheckpointKey, name), t.UTC().Format(time.RFC3339Nano), 0)
+}
+
+type eventRoute struct {
+	name    string
+	prefix  string
+	suffix  string
+	events  []string
+	handler EventHandler
+}
+
+func (r *eventRoute) match(event notification.Event) bool {
+	key := event.S3.Object.Key
+	if !strings.HasPrefix(key, r.prefix) || !strings.HasSuffix(key, r.suffix) {
+		return false
+	}
+	if len(r.events) == 0 {
+		return true
+	}
+	for _, e := range r.events {
+		if strings.HasPrefix(event.EventName, strings.TrimSuffix(e, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventSubscriber 订阅 bucket 事件并按前缀、后缀分发给注册的 handler
+// 启动时先从 checkpoint 开始扫描 bucket 补发停机期间新增的对象，之后消费实时事件
+// 每个 handler 按 (handler, bucket, key, etag) 去重，失败按指数退避重试
+type EventSubscriber struct {
+	Loader     *OssLoader
+	Bucket     string
+	Prefix     string // 订阅的前缀，为空表示整个 bucket
+	Name       string // checkpoint 名字，默认 bucket 名
+	Store      EventStore
+	MaxRetry   int           // 默认 3
+	RetryDelay time.Duration // 首次重试间隔，之后翻倍，默认 1s
+	// OnFailed 重试用尽后调用，用于记录到死信队列；配置后失败的事件交给 OnFailed，checkpoint 继续推进
+	// 没有配置时 checkpoint 停在第一个失败事件之前，重启或重连后从该位置补扫重试
+	OnFailed func(ctx context.Context, handler string, event notification.Event, err error)
+
+	mu         sync.Mutex
+	routes     []*eventRoute
+	checkpoint time.Time
+	failedAt   time.Time // 最早的未处理成功的事件时间，checkpoint 不会超过它
+}
+
+func NewEventSubscriber(loader *OssLoader, bucket string, store EventStore) *EventSubscriber {
+	if store == nil {
+		store = NewMemoryEventStore()
+	}
+	return &EventSubscriber{Loader: loader, Bucket: bucket, Store: store, MaxRetry: 3, RetryDelay: time.Second}
+}
+
+// Handle 注册 handler，name 用于去重和日志，必须唯一；events 为空表示所有事件，支持 s3:ObjectCreated:* 形式
+func (s *EventSubscriber) Handle(name string, prefix string, suffix string, events []string, handler EventHandler) *EventSubscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = append(s.routes, &eventRoute{name: name, prefix: prefix, suffix: suffix, events: events, handler: handler})
+	return s
+}
+
+func (s *EventSubscriber) name() string {
+	if s.Name == "" {
+		return s.Bucket
+	}
+	return s.Name
+}
+
+// Run 阻塞消费事件直到 ctx 结束，返回 ctx 的错误；监听断开时等待 RetryDelay 后重连，并从 checkpoint 补扫断开期间的对象
+func (s *EventSubscriber) Run(ctx context.Context) error {
+	minioClient, err := s.Loader.GetClient()
+	if err != nil {
+		return err
+	}
+	checkpoint, err := s.Store.LoadCheckpoint(ctx, s.name())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.checkpoint = checkpoint
+	s.mu.Unlock()
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	since := checkpoint
+	for {
+		// 先开始监听再补扫，补扫和实时事件重叠的部分由去重过滤
+		infoCh := minioClient.ListenBucketNotification(ctx, s.Bucket, s.Prefix, "", []string{
+			string(notification.ObjectCreatedAll),
+			string(notification.ObjectRemovedAll),
+		})
+		if !since.IsZero() {
+			if err := s.catchUp(ctx, minioClient, since); err != nil {
+				logs.CtxErrorf(ctx, "EventSubscriber %v catch up fail %v", s.name(), err)
+			}
+		}
+		for info := range infoCh {
+			if info.Err != nil {
+				logs.CtxWarnf(ctx, "EventSubscriber %v listen fail %v", s.name(), info.Err)
+				continue
+			}
+			for _, event := range info.Records {
+				s.Dispatch(ctx, event)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		disconnectAt := time.Now()
+		logs.CtxWarnf(ctx, "EventSubscriber %v listen closed, reconnect in %v", s.name(), delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		// 还没有 checkpoint 时从断开的时间开始补扫，留 1 分钟给时钟误差
+		if since = s.resumeFrom(); since.IsZero() {
+			since = disconnectAt.Add(-time.Minute)
+		}
+	}
+}
+
+// resumeFrom 重连后补扫的起点，有失败事件时从失败事件之前开始
+func (s *EventSubscriber) resumeFrom() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failedAt.IsZero() && (s.checkpoint.IsZero() || s.failedAt.Before(s.checkpoint)) {
+		return s.failedAt.Add(-time.Nanosecond)
+	}
+	return s.checkpoint
+}
+
+// Start 在后台执行 Run
+func (s *EventSubscriber) Start(ctx context.Context) {
+	go func() {
+		if err := s.Run(ctx); err != nil && ctx.Err() == nil {
+			logs.CtxErrorf(ctx, "EventSubscriber %v stopped %v", s.name(), err)
+		}
+	}()
+}
+
+// catchUp 对 checkpoint 之后修改的对象补发 ObjectCreated 事件，删除事件无法补发
+// 列出的对象按名字而不是时间排序，全部处理完才推进 checkpoint，中途重启会从头补扫；有失败的事件时 checkpoint 停在最早的失败事件之前
+func (s *EventSubscriber) catchUp(ctx context.Context, minioClient *minio.Client, since time.Time) error {
+	// 之前失败的事件都在 since 之后，会重新处理，补扫中断时保留
+	s.mu.Lock()
+	prevFailed := s.failedAt
+	s.failedAt = time.Time{}
+	s.mu.Unlock()
+	var latest notification.Event
+	var latestTime time.Time
+	for obj := range minioClient.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.Prefix, Recursive: true}) {
+		if obj.Err != nil {
+			if !prevFailed.IsZero() {
+				s.markFailed(prevFailed)
+			}
+			return obj.Err
+		}
+		if !obj.LastModified.After(since) {
+			continue
+		}
+		event := notification.Event{
+			EventName: EventObjectCreated + "Put",
+			EventTime: obj.LastModified.UTC().Format(time.RFC3339Nano),
+		}
+		event.S3.Bucket.Name = s.Bucket
+		event.S3.Object.Key = obj.Key
+		event.S3.Object.Size = obj.Size
+		event.S3.Object.ETag = obj.ETag
+		event.S3.Object.ContentType = obj.ContentType
+		if !s.dispatch(ctx, event) {
+			s.markFailed(obj.LastModified)
+		}
+		if obj.LastModified.After(latestTime) {
+			latest, latestTime = event, obj.LastModified
+		}
+	}
+	if !latestTime.IsZero() {
+		s.advance(ctx, latest)
+	}
+	return nil
+}
+
+// Dispatch 把事件交给匹配的 handler 处理，所有 handler 成功或失败事件已交给 OnFailed 时推进 checkpoint
+func (s *EventSubscriber) Dispatch(ctx context.Context, event notification.Event) {
+	if !s.dispatch(ctx, event) {
+		if t, err := time.Parse(time.RFC3339Nano, event.EventTime); err == nil {
+			s.markFailed(t)
+		}
+	}
+	s.advance(ctx, event)
+}
+
+// dispatch 返回事件是否已处理，有 handler 失败且没有配置 OnFailed 时返回 false
+func (s *EventSubscriber) dispatch(ctx context.Context, event notification.Event) bool {
+	ok := true
+	s.mu.Lock()
+	routes := append([]*eventRoute{}, s.routes...)
+	s.mu.Unlock()
+	for _, r := range routes {
+		if !r.match(event) {
+			continue
+		}
+		key := eventKey(r.name, event)
+		if s.Store.IsDone(ctx, key) {
+			continue
+		}
+		if err := s.handleWithRetry(ctx, r, event); err != nil {
+			logs.CtxErrorf(ctx, "EventSubscriber handler %v key=%v fail %v", r.name, event.S3.Object.Key, err)
+			if s.OnFailed == nil {
+				ok = false
+				continue
+			}
+			s.OnFailed(ctx, r.name, event, err)
+			continue
+		}
+		if err := s.Store.MarkDone(ctx, key); err != nil {
+			logs.CtxWarnf(ctx, "EventSubscriber mark done %v fail %v", key, err)
+		}
+	}
+	return ok
+}
+
+// markFailed 记录未处理成功的事件时间，checkpoint 不再越过它
+func (s *EventSubscriber) markFailed(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failedAt.IsZero() || t.Before(s.failedAt) {
+		s.failedAt = t
+	}
+}
+
+func (s *EventSubscriber) handleWithRetry(ctx context.Context, r *eventRoute, event notification.Event) error {
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	var err error
+	for i := 0; i <= s.MaxRetry; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		if err = safeHandle(ctx, r.handler, event); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// safeHandle handler panic 时转为错误
+func safeHandle(ctx context.Context, handler EventHandler, event notification.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic %v", r)
+		}
+	}()
+	return handler(ctx, event)
+}
+
+func (s *EventSubscriber) advance(ctx context.Context, event notification.Event) {
+	t, err := time.Parse(time.RFC3339Nano, event.EventTime)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.failedAt.IsZero() && !t.Before(s.failedAt) {
+		t = s.failedAt.Add(-time.Nanosecond)
+	}
+	if !t.After(s.checkpoint) {
+		s.mu.Unlock()
+		return
+	}
+	s.checkpoint = t
+	s.mu.Unlock()
+	if err := s.Store.SaveCheckpoint(ctx, s.name(), t); err != nil {
+		logs.CtxWarnf(ctx, "EventSubscriber save checkpoint fail %v", err)
+	}
+}
+
+// eventKey 去重 key，同一对象同一内容的创建事件只处理一次，删除事件使用 sequencer 区分
+func eventKey(handler string, event notification.Event) string {
+	category := event.EventName
+	if i := strings.LastIndex(category, ":"); i >= 0 {
+		category = category[:i]
+	}
+	version := strings.Trim(event.S3.Object.ETag, "\"")
+	if version == "" {
+		version = event.S3.Object.Sequencer
+	}
+	sum := md5.Sum([]byte(strings.Join([]string{handler, category, event.S3.Bucket.Name, event.S3.Object.Key, version}, "|")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/putils"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultListPageSize = 100
+	MaxListPageSize     = 1000
+)
+
+// ObjectPage 分页列出的对象，NextToken 为空表示已经没有更多
+type ObjectPage struct {
+	Objects   []minio.ObjectInfo `json:"objects"`
+	NextToken string             `json:"next_token"`
+}
+
+// ListObjects 按前缀分页列出对象，按对象名字典序返回，token 传上一页的 NextToken
+// recursive 为 false 时只列出一层，子目录以 / 结尾的公共前缀返回
+func (u *OssLoader) ListObjects(ctx context.Context, bucket string, prefix string, token string, pageSize int, recursive bool) (*ObjectPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	if pageSize > MaxListPageSize {
+		pageSize = MaxListPageSize
+	}
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	// 取够一页后取消，避免 minio 继续拉取后续数据
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	page := &ObjectPage{Objects: make([]minio.ObjectInfo, 0, pageSize)}
+	for obj := range minioClient.ListObjects(listCtx, bucket, minio.ListObjectsOptions{
+		Prefix:     prefix,
+		StartAfter: token,
+		Recursive:  recursive,
+		MaxKeys:    pageSize,
+	}) {
+		if obj.Err != nil {
+			return nil, errors.WithMessage(obj.Err, "ListObjects fail")
+		}
+		if len(page.Objects) == pageSize {
+			page.NextToken = page.Objects[pageSize-1].Key
+			break
+		}
+		page.Objects = append(page.Objects, obj)
+	}
+	return page, nil
+}
+
+// CopyObject 服务端复制，不经过本地；userMetadata 不为空时替换目标对象的元数据，否则保留源对象的元数据
+func (u *OssLoader) CopyObject(ctx context.Context, srcBucket string, srcObject string, dstBucket string, dstObject string, userMetadata map[string]string) (*minio.UploadInfo, error) {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	dst := minio.CopyDestOptions{Bucket: dstBucket, Object: dstObject}
+	if len(userMetadata) > 0 {
+		dst.UserMetadata = userMetadata
+		dst.ReplaceMetadata = true
+	}
+	info, err := minioClient.CopyObject(ctx, dst, minio.CopySrcOptions{Bucket: srcBucket, Object: srcObject})
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("CopyObject %v/%v to %v/%v fail", srcBucket, srcObject, dstBucket, dstObject))
+	}
+	return &info, nil
+}
+
+// MoveObject 先复制再删除源对象，删除失败时目标对象保留并返回错误
+func (u *OssLoader) MoveObject(ctx context.Context, srcBucket string, srcObject string, dstBucket string, dstObject string) (*minio.UploadInfo, error) {
+	if srcBucket == dstBucket && srcObject == dstObject {
+		return nil, fmt.Errorf("MoveObject src and dst are the same")
+	}
+	info, err := u.CopyObject(ctx, srcBucket, srcObject, dstBucket, dstObject, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 源对象的记录复制到目标对象，删除源对象时再软删除原记录
+	if repo := u.fileRepo(); repo != nil {
+		records, err := repo.QueryByObject(ctx, srcBucket, srcObject)
+		if err != nil {
+			return info, errors.WithMessage(err, "MoveObject query file fail")
+		}
+		for _, record := range records {
+			moved := *record
+			moved.ID = 0
+			moved.Url = u.objectRef(dstBucket, dstObject)
+			moved.Path = dstObject
+			moved.Bucket = dstBucket
+			moved.MinioKey = dstObject
+			if _, err = u.saveFile(ctx, &moved); err != nil {
+				return info, err
+			}
+		}
+	}
+	if err := u.RemoveObject(ctx, srcBucket, srcObject); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// BatchDeleteResult 批量删除结果，Failed 为删除失败的对象及原因
+type BatchDeleteResult struct {
+	Deleted int              `json:"deleted"`
+	Failed  map[string]error `json:"-"`
+}
+
+// RemoveObjects 批量删除，单个对象失败不影响其他对象，失败原因记录在 Failed 中
+func (u *OssLoader) RemoveObjects(ctx context.Context, bucket string, objects []string) (*BatchDeleteResult, error) {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	// ctx 结束时只统计已发送的对象，生产者退出后通过 sent 返回个数
+	sent := make(chan int, 1)
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		n := 0
+		defer func() {
+			close(objectsCh)
+			sent <- n
+		}()
+		for _, object := range objects {
+			select {
+			case objectsCh <- minio.ObjectInfo{Key: object}:
+				n++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	res := collectRemoveErrors(minioClient.RemoveObjects(ctx, bucket, objectsCh, minio.RemoveObjectsOptions{}))
+	objects = objects[:<-sent]
+	res.Deleted = len(objects) - len(res.Failed)
+	u.releaseObjects(ctx, bucket, objects, res)
+	return res, ctx.Err()
+}
+
+// releaseObjects 软删除已删除对象的记录并扣减用量，失败的记录到 res.Failed
+func (u *OssLoader) releaseObjects(ctx context.Context, bucket string, objects []string, res *BatchDeleteResult) {
+	for _, object := range objects {
+		if _, failed := res.Failed[object]; failed {
+			continue
+		}
+		if err := u.releaseObject(ctx, bucket, object); err != nil {
+			logs.CtxErrorf(ctx, "release object bucket=%v object=%v fail %v", bucket, object, err)
+			res.Failed[object] = err
+			res.Deleted--
+		}
+	}
+}
+
+// collectRemoveErrors 读取删除失败的对象，Deleted 由调用方按已发送的个数计算
+func collectRemoveErrors(errCh <-chan minio.RemoveObjectError) *BatchDeleteResult {
+	res := &BatchDeleteResult{Failed: map[string]error{}}
+	for e := range errCh {
+		res.Failed[e.ObjectName] = e.Err
+	}
+	return res
+}
+
+// RemoveObjectsOlderThan 删除 prefix 下最后修改时间早于 before 的所有对象
+func (u *OssLoader) RemoveObjectsOlderThan(ctx context.Context, bucket string, prefix string, before time.Time) (*BatchDeleteResult, error) {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	// 生产者退出后通过 listed 返回已发送的对象和列举错误
+	type listResult struct {
+		objects []string
+		err     error
+	}
+	listed := make(chan listResult, 1)
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		var res listResult
+		defer func() {
+			close(objectsCh)
+			listed <- res
+		}()
+		for obj := range minioClient.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				res.err = obj.Err
+				return
+			}
+			if !obj.LastModified.Before(before) {
+				continue
+			}
+			select {
+			case objectsCh <- obj:
+				res.objects = append(res.objects, obj.Key)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	res := collectRemoveErrors(minioClient.RemoveObjects(ctx, bucket, objectsCh, minio.RemoveObjectsOptions{}))
+	lr := <-listed
+	res.Deleted = len(lr.objects) - len(res.Failed)
+	u.releaseObjects(ctx, bucket, lr.objects, res)
+	if lr.err != nil {
+		return res, errors.WithMessage(lr.err, "RemoveObjectsOlderThan list fail")
+	}
+	return res, ctx.Err()
+}
+
+// PrefixCleaner 按保留策略定期删除 Prefix 下超过 MaxAge 的对象
+type PrefixCleaner struct {
+	Loader   *OssLoader
+	Bucket   string
+	Prefix   string // 不能为空，避免误删整个 bucket
+	MaxAge   time.Duration
+	Interval time.Duration
+}
+
+// RunOnce 清理一次
+func (c *PrefixCleaner) RunOnce(ctx context.Context) (*BatchDeleteResult, error) {
+	if c.Prefix == "" {
+		return nil, fmt.Errorf("PrefixCleaner prefix is empty")
+	}
+	if c.MaxAge <= 0 {
+		return nil, fmt.Errorf("PrefixCleaner max age must be positive")
+	}
+	return c.Loader.RemoveObjectsOlderThan(ctx, c.Bucket, c.Prefix, time.Now().Add(-c.MaxAge))
+}
+
+// Start 在后台按 Interval 定期执行 RunOnce，ctx 结束时退出
+func (c *PrefixCleaner) Start(ctx context.Context) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			putils.GoFuncDone(ctx, wg, nil, func(ctx context.Context, param interface{}) {
+				res, err := c.RunOnce(ctx)
+				if err != nil {
+					logs.CtxErrorf(ctx, "PrefixCleaner bucket=%v prefix=%v fail %v", c.Bucket, c.Prefix, err)
+				}
+				if res == nil {
+					return
+				}
+				if res.Deleted > 0 {
+					logs.CtxInfof(ctx, "PrefixCleaner bucket=%v prefix=%v deleted %v objects", c.Bucket, c.Prefix, res.Deleted)
+				}
+				for object, err := range res.Failed {
+					logs.CtxWarnf(ctx, "PrefixCleaner remove %v fail %v", object, err)
+				}
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
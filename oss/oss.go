@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
 	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"net/url"
 	"strings"
 	"sync"
@@ -16,30 +15,35 @@ import (
 	"io"
 
 	"github.com/EICHI-X/ptools/logs"
-	"github.com/EICHI-X/ptools/paerospike"
 	"github.com/EICHI-X/ptools/purl"
 	"github.com/EICHI-X/ptools/putils"
 	"github.com/bytedance/sonic"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/nfnt/resize"
 	"github.com/pkg/errors"
+	"gorm.io/gorm"
 )
 
-// url 作为唯一key
+// url + owner 作为唯一key，内容去重后多个 owner 可以共享同一个 url
 type Blog_file struct {
-	Filename    string `gorm:"filename" json:"filename"`         // 文件名字
-	ContentType string `gorm:"content_type" json:"content_type"` // 内容类型
-	Owner       string `gorm:"owner" json:"owner"`               // 用户名
-	Url         string `gorm:"url" json:"url"`                   // url
-	Href        string `gorm:"href" json:"href"`                 // href
-	Path        string `gorm:"path" json:"path"`                 // 路径
-	Bucket      string `gorm:"bucket" json:"bucket"`             // Bucket
-	Alt         string `gorm:"alt" json:"alt"`                   // alt
-	Md5         string `gorm:"md5" json:"md5"`                   // md5
-	Prefix      string `gorm:"prefix" json:"prefix"`             // 前缀
-	MinioKey    string `gorm:"minio_key" json:"minio_key"`       // minio_key的key
-	SaveType    string `gorm:"save_type" json:"save_type"`       // 存储类型
+	ID          int64          `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Filename    string         `gorm:"column:filename" json:"filename"`                                               // 文件名字
+	ContentType string         `gorm:"column:content_type" json:"content_type"`                                       // 内容类型
+	Owner       string         `gorm:"column:owner;uniqueIndex:uk_blog_file_url_owner,priority:2;index" json:"owner"` // 用户名
+	Url         string         `gorm:"column:url;uniqueIndex:uk_blog_file_url_owner,priority:1;index" json:"url"`     // url
+	Href        string         `gorm:"column:href" json:"href"`                                                       // href
+	Path        string         `gorm:"column:path" json:"path"`                                                       // 路径
+	Bucket      string         `gorm:"column:bucket" json:"bucket"`                                                   // Bucket
+	Alt         string         `gorm:"column:alt" json:"alt"`                                                         // alt
+	Md5         string         `gorm:"column:md5;index" json:"md5"`                                                   // md5
+	Prefix      string         `gorm:"column:prefix" json:"prefix"`                                                   // 前缀
+	MinioKey    string         `gorm:"column:minio_key" json:"minio_key"`                                             // minio_key的key
+	SaveType    string         `gorm:"column:save_type" json:"save_type"`                                             // 存储类型
+	Variants    string         `gorm:"column:variants" json:"variants,omitempty"`                                     // 图片变体，json 格式 {"thumb":"a_thumb.jpg"}
+	Size        int64          `gorm:"column:size" json:"size"`                                                       // 字节数，包括图片变体，用于配额统计
+	CreatedAt   time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt   time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"column:deleted_at;index" json:"-"`
 }
 
 func (a *Blog_file) TableName() string {
@@ -56,7 +60,23 @@ type OssLoader struct {
 	FileUrl     string
 	DefaultDir  string
 	Host        string
+	Region      string
 	MinioClient *minio.Client
+
+	Creds     *credentials.Credentials // 不为空时优先于 AccessKeyID/SecretAccessKey，用于凭证轮换
+	Transport http.RoundTripper        // 为空时使用 NewTransport(UseSSL, DefaultTransportOption())
+	FileRepo  *FileRepository          // 文件元数据仓库，为空时使用 SetFileRepository 设置的默认仓库
+	Validator *UploadValidator         // 不为空时表单上传前校验类型、大小并扫描内容
+	UrlCache  *UrlCacheConfig          // 签名地址缓存，为空时使用默认的 aerospike 缓存
+	Hosts     *HostSelector            // 不为空时按健康状态和 region 在 Object 的 Host/SubHosts 中选择
+	Cdn       *CdnConfig               // 不为空时公开 bucket 的对象返回 CDN 地址，不再签名
+	Refs      *RefCodec                // 文件引用的签名和校验，为空时只接受未签名的旧格式
+	Quota     *Quota                   // 不为空时按 owner 统计用量，上传前检查配额
+	Dedup     *Deduper                 // 不为空时上传到 Dedup.Bucket 的文件按内容去重
+	Envelope  *Envelope                // 不为空时上传加密保存，下载自动解密信封加密的对象
+	clientMu  sync.Mutex
+
+	hostClients map[string]*minio.Client
 }
 type ObjectEncodeType int
 
@@ -126,11 +146,17 @@ func DecodeUrlToObject(url string) (*Object, error) {
 	return &v, nil
 
 }
+
+// EncodeToHttps 拼接 https 地址，Host 为空时使用第一个 SubHosts，都为空时返回空字符串
 func (o *Object) EncodeToHttps() string {
-	if o.Host == "" {
-		o.Host = ""
+	host := o.Host
+	for i := 0; host == "" && i < len(o.SubHosts); i++ {
+		host = o.SubHosts[i]
 	}
-	return fmt.Sprintf("https://%v/%v/%v", o.Host, o.Bucket, o.Object)
+	if host == "" {
+		return ""
+	}
+	return "https://" + host + ObjectPath(o)
 }
 func (o *Object) DecodeHttps(url string) error {
 
@@ -176,196 +202,230 @@ func (o *Object) PresignedGetObject(ctx context.Context, client *OssLoader, expi
 }
 
 func (o *OssLoader) GetRealUrlFromEncodedUrl(ctx context.Context, urlStr string, expiry time.Duration) (string, error) {
+	return o.GetRealUrlFromEncodedUrlInRegion(ctx, urlStr, expiry, o.Region)
+}
+
+// GetRealUrlFromEncodedUrlInRegion 公开 bucket 返回 CDN 地址，否则优先使用 region 内健康的 host 签名
+func (o *OssLoader) GetRealUrlFromEncodedUrlInRegion(ctx context.Context, urlStr string, expiry time.Duration, region string) (string, error) {
 	if isHttpUrl(urlStr) {
 		return urlStr, nil
 	}
-	if !IsOssUrlEncodedUrl(urlStr) {
-		return "", fmt.Errorf("url is not valid %v", urlStr)
+	object, directUrl, err := o.decodeRef(urlStr)
+	if err != nil {
+		return "", errors.WithMessage(err, fmt.Sprintf("url is not valid %v", urlStr))
+	}
+	if object == nil {
+		return directUrl, nil
 	}
+	return o.realUrl(ctx, object, expiry, region)
+}
 
-	object, err := DecodeUrlToObject(urlStr)
+// decodeRef 解析 v1 签名引用和两种旧格式，返回需要签名的对象；引用本身就是地址时返回 directUrl
+func (o *OssLoader) decodeRef(urlStr string) (*Object, string, error) {
+	ref, err := o.refCodec().Decode(urlStr)
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+	if object := ref.ToObject(); object != nil {
+		return object, "", nil
+	}
+	if ref.URL != "" {
+		return nil, ref.URL, nil
+	}
+	return nil, "", fmt.Errorf("file reference has no object")
+}
+
+// realUrl 公开 bucket 返回 CDN 地址，否则签名，签名失败时切换 host
+func (o *OssLoader) realUrl(ctx context.Context, object *Object, expiry time.Duration, region string) (string, error) {
+	if cdnUrl, ok := o.Cdn.Rewrite(object); ok {
+		return cdnUrl, nil
 	}
 	var reqParams url.Values
 	if object.ReqParams != nil {
 		reqParams = *object.ReqParams
 	}
-	urlInfo, err := o.PresignedGetObject(ctx, object.Bucket, object.Object, expiry, reqParams)
-	if err != nil || urlInfo == nil {
-		return "", err
-	}
-	return urlInfo.String(), err
-}
-func getMinioClientWithRetry(o *OssLoader, retryTime int) (*minio.Client, error) {
-	var minioClient *minio.Client
-	var err error
-	for retry := retryTime; retry > 0; retry-- {
-		minioClient, err = minio.New(o.Endpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(o.AccessKeyID, o.SecretAccessKey, ""),
-			Secure: o.UseSSL,
-		})
-		if minioClient == nil || err != nil {
-			continue
+	res := ""
+	err := o.DoWithFailover(ctx, object, region, func(client *minio.Client, host string) error {
+		urlInfo, err := client.PresignedGetObject(ctx, object.Bucket, object.Object, expiry, reqParams)
+		if err != nil {
+			return err
 		}
-		break
-	}
-	return minioClient, err
+		if urlInfo == nil {
+			return fmt.Errorf("presign url %v fail", object.Object)
+		}
+		res = urlInfo.String()
+		return nil
+	})
+	return res, err
 }
-func (o *OssLoader) GetRealUrlsWithCache(ctx context.Context, urls []string, expiry time.Duration, retryTime int) ([]string, error) {
+
+// GetRealUrlsWithCache 批量把编码地址转换为签名地址，优先读缓存，http 地址原样返回
+// 返回的 errs 与 urls 等长，某个地址签名失败时对应位置的地址为空，不影响其他地址
+func (o *OssLoader) GetRealUrlsWithCache(ctx context.Context, urls []string, expiry time.Duration, retryTime int) ([]string, []error) {
 	defer putils.TimeCostWithMsg(ctx, fmt.Sprintf("GetRealUrlsWithCache target expiry  %v", expiry))()
 	objs := make([]*Object, len(urls))
-	keys := make([]string, len(urls))
 	resUrls := make([]string, len(urls))
-	keyPattern := "1000|packer|article.%v"
+	errs := make([]error, len(urls))
+	cacheCfg := o.urlCache()
+	keys := make([]string, 0, len(urls))
+	keyIdxs := make([]int, 0, len(urls))
 	for i, urlStr := range urls {
-		if isHttpUrl(urlStr) || !IsOssUrlEncodedUrl(urlStr) {
+		if isHttpUrl(urlStr) {
+			resUrls[i] = urlStr
+			continue
+		}
+		object, directUrl, err := o.decodeRef(urlStr)
+		if errors.Is(err, ErrNotRef) {
+			// 不是文件引用的字符串原样返回
 			resUrls[i] = urlStr
 			continue
 		}
-		object, err := DecodeUrlToObject(urlStr)
 		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if object == nil {
+			resUrls[i] = directUrl
+			continue
+		}
+		if cdnUrl, ok := o.Cdn.Rewrite(object); ok {
+			resUrls[i] = cdnUrl
 			continue
 		}
 		objs[i] = object
-		keys[i] = fmt.Sprintf(keyPattern, object.GenKey())
+		keys = append(keys, cacheCfg.key(object))
+		keyIdxs = append(keyIdxs, i)
 	}
-	cacheClient := paerospike.NewDefaultClient("aerospike.stock.packer")
-	if cacheClient == nil {
-		return resUrls, fmt.Errorf("paerospike client is nil")
-	}
-	cacheResp, err := cacheClient.GetBatch(keys, 100)
-	emptyUrlObjs := make([]*Object, 0, len(urls))
-	emptyObjIdxs := make([]int, 0, len(urls))
-	if len(cacheResp) != len(urls) || err != nil {
-		logs.CtxErrorf(ctx, "cacheResp len not match", putils.ToJsonSonic(urls))
-	}
-	for idx := range urls {
-		urlStr := ""
-		if idx < len(cacheResp) && len(cacheResp[idx]) > 0 {
-			urlStr = cacheResp[idx]
-
+	if cacheCfg.Cache != nil && len(keys) > 0 {
+		cacheResp, err := cacheCfg.Cache.GetBatch(ctx, keys)
+		if err != nil {
+			// 缓存不可用时全部重新签名
+			logs.CtxWarnf(ctx, "GetRealUrlsWithCache get cache fail %v", err)
 		}
-		// url 和 objs[idx] 不为空
-		if len(urlStr) == 0 && objs[idx] != nil && len(urls[idx]) > 0 {
-			emptyUrlObjs = append(emptyUrlObjs, objs[idx])
-			emptyObjIdxs = append(emptyObjIdxs, idx)
-		} else if len(urls[idx]) > 0 && len(urlStr) > 0 {
-			resUrls[idx] = urlStr
+		for j, idx := range keyIdxs {
+			if j < len(cacheResp) && len(cacheResp[j]) > 0 {
+				resUrls[idx] = cacheResp[j]
+				objs[idx] = nil
+			}
 		}
-
 	}
-	minioClient, err := getMinioClientWithRetry(o, 1)
-	if minioClient == nil || err != nil {
-		return cacheResp, err
+	if retryTime <= 0 {
+		retryTime = 1
 	}
 	wg := &sync.WaitGroup{}
-	for i := range emptyUrlObjs {
+	for i := range objs {
 		idx := i
-		obj := emptyUrlObjs[i]
-		if obj == nil || obj.Bucket == "" || obj.Object == "" {
+		obj := objs[i]
+		if obj == nil {
 			continue
 		}
 		wg.Add(1)
 		go putils.GoFuncDone(ctx, wg, nil, func(ctx context.Context, param interface{}) {
-			if retryTime <= 0 {
-				retryTime = 1
-			}
+			var lastErr error
 			for retry := retryTime; retry > 0; retry-- {
-				if retry < retryTime {
-					minioClient, err := getMinioClientWithRetry(o, 1)
-					if minioClient == nil || err != nil {
-						continue
-					}
+				if ctx.Err() != nil {
+					lastErr = ctx.Err()
+					break
 				}
-				url, err := minioClient.PresignedGetObject(ctx, obj.Bucket, obj.Object, expiry, nil)
-				if err != nil || url == nil {
+				realUrl, err := o.realUrl(ctx, obj, expiry, o.Region)
+				if err != nil || realUrl == "" {
+					lastErr = err
 					continue
 				}
-				resUrls[emptyObjIdxs[idx]] = url.String()
-				// cache 的时间单位是秒，minio的时间单位是time.Duration,这里需要转换
-				cacheExpiry := (expiry / 2) / time.Second // 缓存是真实事件的一半
-				_ = cacheClient.PutAsync(fmt.Sprintf(keyPattern, obj.GenKey()), resUrls[emptyObjIdxs[idx]], uint32(cacheExpiry))
+				resUrls[idx] = realUrl
+				lastErr = nil
+				if ttl := cacheCfg.ttl(expiry); cacheCfg.Cache != nil && ttl > 0 {
+					if err := cacheCfg.Cache.Set(ctx, cacheCfg.key(obj), resUrls[idx], ttl); err != nil {
+						logs.CtxWarnf(ctx, "GetRealUrlsWithCache set cache fail %v", err)
+					}
+				}
 				break
 			}
+			if lastErr == nil && resUrls[idx] == "" {
+				lastErr = fmt.Errorf("presign url %v fail", urls[idx])
+			}
+			errs[idx] = lastErr
 		})
-
 	}
 	wg.Wait()
-	return resUrls, err
+	return resUrls, errs
 }
 func NewOssLoader(endpoint string, AccessKeyID string, secretAccessKey string) (*OssLoader, error) {
-	p := &OssLoader{
-		Endpoint:        endpoint,
-		AccessKeyID:     AccessKeyID,
-		SecretAccessKey: secretAccessKey,
-		UseSSL:          false,
-
-		// Prefix: "stock",
-		Host: endpoint,
-	}
-	minioClient, err := minio.New(p.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(p.AccessKeyID, p.SecretAccessKey, ""),
-		Secure: p.UseSSL,
-	})
-	if err != nil {
-		return nil, err
-	}
-	p.MinioClient = minioClient
-	return p, nil
+	return NewOssLoaderWithOptions(endpoint, WithStaticCredentials(AccessKeyID, secretAccessKey))
 }
 
 // 这里上传对外暴露的url是filename
 func (u *OssLoader) UploadFromForm(ctx context.Context, bucket string, file multipart.File, fileObj *multipart.FileHeader, hashKey string) (string, string, error) {
 	// 实现上传逻辑，返回文件路径与错误信息
-	minioClient, err := minio.New(u.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, ""),
-		Secure: u.UseSSL,
-	})
+	_, err := u.GetClient()
 	if err != nil {
 		// 如果minioClient创建失败，返回
 		return "", "", err
 	}
-	// minio存储中的对象名称
-
-	// 获取上传的文件句柄
+	if d := u.dedupFor(bucket); d != nil {
+		record, err := u.uploadDedup(ctx, d, file, fileObj)
+		if err != nil {
+			return "", "", err
+		}
+		return record.MinioKey, record.MinioKey, nil
+	}
+	reader, objectName, err := u.validateUpload(ctx, bucket, file, fileObj)
 	if err != nil {
-		// 打开上传文件句柄失败，返回
 		return "", "", err
 	}
 	// 调用Minio/ Sdk的对象上传
-
-	info, err := minioClient.PutObject(ctx, bucket, fileObj.Filename, file, fileObj.Size, minio.PutObjectOptions{})
+	putOption := minio.PutObjectOptions{}
+	if u.Validator != nil {
+		putOption.ContentType = fileObj.Header.Get("Content-Type")
+	}
+	info, err := u.putObject(ctx, bucket, objectName, reader, fileObj.Size, putOption)
 	if err != nil {
 		// 对象上传失败，返回
 		return "", "", err
 	}
-	url := fileObj.Filename
+	url := objectName
+	if _, err = u.saveFile(ctx, u.uploadedFile(bucket, info.Key, fileObj, info.ETag)); err != nil {
+		return "", "", err
+	}
 	return info.Key, url, nil
 }
-func (u *OssLoader) RemoveObject(bucket string, object string) {
-	opts := minio.RemoveObjectOptions{}
-	err := u.MinioClient.RemoveObject(context.Background(), bucket, object, opts)
-	if err != nil {
 
-		return
+// RemoveObject 删除单个对象，同时软删除引用它的记录并扣减用量，对象不存在不会返回错误
+func (u *OssLoader) RemoveObject(ctx context.Context, bucket string, object string) error {
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return err
+	}
+	err = minioClient.RemoveObject(ctx, bucket, object, minio.RemoveObjectOptions{})
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("RemoveObject bucket=%v object=%v fail", bucket, object))
 	}
+	return u.releaseObject(ctx, bucket, object)
 }
 
 // 这里上传对外暴露的url是filename
 func (u *OssLoader) UploadFromFile(ctx context.Context, bucket string, file io.Reader, fileObj *multipart.FileHeader, isCheckEixst bool) (info *minio.UploadInfo, statInfo *minio.ObjectInfo, err error) {
 	// 实现上传逻辑，返回文件路径与错误信息
-	minioClient, err := minio.New(u.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, ""),
-		Secure: u.UseSSL,
-	})
+	minioClient, err := u.GetClient()
 	info = &minio.UploadInfo{}
 	if err != nil {
 		// 如果minioClient创建失败，返回
 		return
 	}
+	if d := u.dedupFor(bucket); d != nil {
+		var record *Blog_file
+		if record, err = u.uploadDedup(ctx, d, file, fileObj); err != nil {
+			return
+		}
+		info = &minio.UploadInfo{Bucket: bucket, Key: record.MinioKey, Size: record.Size, ETag: record.Md5}
+		return
+	}
+	file, objectName, err := u.validateUpload(ctx, bucket, file, fileObj)
+	if err != nil {
+		return
+	}
 	// minio存储中的对象名称
-	stat, err := minioClient.StatObject(ctx, bucket, fileObj.Filename, minio.GetObjectOptions{})
+	stat, err := minioClient.StatObject(ctx, bucket, objectName, minio.GetObjectOptions{})
 	statInfo = &stat
 	if err == nil && stat.Size > 0 {
 		if isCheckEixst {
@@ -382,34 +442,50 @@ func (u *OssLoader) UploadFromFile(ctx context.Context, bucket string, file io.R
 		putOption.ContentType = contentType
 	}
 
-	infoUpload, err := minioClient.PutObject(ctx, bucket, fileObj.Filename, file, fileObj.Size, putOption)
+	infoUpload, err := u.putObject(ctx, bucket, objectName, file, fileObj.Size, putOption)
 	if err != nil {
-		logs.CtxInfof(context.Background(), "upload fail %v", err)
+		logs.CtxInfof(ctx, "upload fail %v", err)
 		// 对象上传失败，返回
 		return
 	}
 	info = &infoUpload
+	_, err = u.saveFile(ctx, u.uploadedFile(bucket, info.Key, fileObj, info.ETag))
 
 	return
 }
 
 // 这里上传对外暴露的url是filename
+// 图片都会按 EXIF 旋转后重新编码以去掉元数据，编码后超过 maxSize 字节时先降低 jpeg 质量，仍然超出再等比缩小尺寸，maxSize 为 0 表示不限制
+// 输出格式与扩展名不一致时对象名和文件名改为对应的扩展名
 func (u *OssLoader) UploadImageWithMaxSize(ctx context.Context, bucket string, file io.Reader, fileObj *multipart.FileHeader, isCheckEixst bool, maxSize uint) (info *minio.UploadInfo, statInfo *minio.ObjectInfo, err error) {
-	// 实现上传逻辑，返回文件路径与错误信息
-	// 读取图片
 	info = &minio.UploadInfo{}
 
-	minioClient, err := minio.New(u.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, ""),
-		Secure: u.UseSSL,
-	})
+	minioClient, err := u.GetClient()
 	if err != nil {
 		// 如果minioClient创建失败，返回
 		return
 	}
-	var stat minio.ObjectInfo
+	file, objectName, err := u.validateUpload(ctx, bucket, file, fileObj)
+	if err != nil {
+		return
+	}
+	opt := DefaultImageOption()
+	opt.MaxBytes = int64(maxSize)
+	processed, _, err := ProcessImage(file, opt)
+	if err != nil {
+		return info, nil, errors.WithMessage(err, "parse image fail")
+	}
+	objectName = ReplaceImageExt(objectName, processed.Format)
+	fileObj.Filename = ReplaceImageExt(fileObj.Filename, processed.Format)
+	fileObj.Size = int64(len(processed.Data))
+	if fileObj.Header == nil {
+		fileObj.Header = textproto.MIMEHeader{}
+	}
+	fileObj.Header.Set("Content-Length", fmt.Sprintf("%v", fileObj.Size))
+	fileObj.Header.Set("Content-Type", processed.ContentType)
 
-	stat, err = minioClient.StatObject(ctx, bucket, fileObj.Filename, minio.GetObjectOptions{})
+	var stat minio.ObjectInfo
+	stat, err = minioClient.StatObject(ctx, bucket, objectName, minio.GetObjectOptions{})
 	statInfo = &stat
 	if err == nil && stat.Size > 0 {
 		if isCheckEixst {
@@ -420,73 +496,34 @@ func (u *OssLoader) UploadImageWithMaxSize(ctx context.Context, bucket string, f
 	}
 
 	// 调用Minio/ Sdk的对象上传
-	contentType := fileObj.Header.Get("Content-Type")
-	putOption := minio.PutObjectOptions{}
-	if len(contentType) > 0 {
-		putOption.ContentType = contentType
-	}
-	var infoUpload minio.UploadInfo
-	// minio存储中的对象名称
-	fileSize := fileObj.Size
-	if fileSize > int64(maxSize) {
-		img, format, err1 := image.Decode(file)
-		if err1 != nil {
-			return info, nil, errors.WithMessage(err, "parse image fail")
-		}
-
-		// 关闭文件
-
-		rate := float64(maxSize) / float64(fileSize)
-		fileObj.Size = int64(maxSize)
-		// 设置压缩后的宽度和高度，这里是压缩为原图宽度和高度的 1/4
-		newWidth := uint(float64(img.Bounds().Dx()) * rate)
-		newHeight := uint(float64(img.Bounds().Dy()) * rate)
-		// 压缩图片
-		resizedImg := resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-		// 将压缩后的图片数据写入 bytes.Buffer
-		var buf bytes.Buffer
-		// 可以根据不同的格式执行相应的操作
-		switch format {
-		case "jpeg":
-			err = jpeg.Encode(&buf, resizedImg, nil)
-			if err != nil {
-				return info, nil, err
-			}
-			// 处理 JPEG 格式的图像
-		case "png":
-			err = png.Encode(&buf, resizedImg)
-			if err != nil {
-				return info, nil, err
-			}
-			// 处理 PNG 格式的图像
-		default:
-			fmt.Println("Unsupported image format")
-			return info, nil, errors.New("unsupported image format")
-		}
-		fileObj.Size = int64(buf.Len())
-		fileObj.Header.Set("Content-Length", fmt.Sprintf("%v", fileObj.Size))
-		infoUpload1, err2 := minioClient.PutObject(ctx, bucket, fileObj.Filename, &buf, fileObj.Size, putOption)
-		if err2 != nil {
-			logs.CtxInfof(context.Background(), "upload image fail %v", err)
-			// 对象上传失败，返回
-			return info, nil, err2
-		}
-		infoUpload = infoUpload1
-		err = err2
-
-	} else {
-		infoUpload, err = minioClient.PutObject(ctx, bucket, fileObj.Filename, file, fileObj.Size, putOption)
-
-	}
+	putOption := minio.PutObjectOptions{ContentType: processed.ContentType}
+	infoUpload, err := minioClient.PutObject(ctx, bucket, objectName, bytes.NewReader(processed.Data), fileObj.Size, putOption)
 	if err != nil {
-		logs.CtxInfof(context.Background(), "upload fail %v", err)
+		logs.CtxInfof(ctx, "upload fail %v", err)
 		// 对象上传失败，返回
 		return info, nil, err
 	}
 	info = &infoUpload
+	_, err = u.saveFile(ctx, u.uploadedFile(bucket, info.Key, fileObj, info.ETag))
 
 	return
 }
+
+// uploadedFile 根据上传结果生成元数据，单次上传的 ETag 就是内容 md5
+func (u *OssLoader) uploadedFile(bucket string, key string, fileObj *multipart.FileHeader, etag string) *Blog_file {
+	return &Blog_file{
+		Filename:    fileObj.Filename,
+		ContentType: fileObj.Header.Get("Content-Type"),
+		Url:         u.objectRef(bucket, key),
+		Path:        key,
+		Bucket:      bucket,
+		Md5:         etagMd5(etag),
+		Prefix:      u.Prefix,
+		MinioKey:    key,
+		SaveType:    SaveTypeMinio,
+		Size:        fileObj.Size,
+	}
+}
 func (u *OssLoader) GetFileName(fileName string, hashKey string) string {
 	objectName := "/"
 	if u.Prefix != "" {
@@ -502,40 +539,50 @@ func (u *OssLoader) GetFileName(fileName string, hashKey string) string {
 	return objectName
 }
 func (u *OssLoader) PresignedGetObject(ctx context.Context, bucket string, objectName string, expiry time.Duration, reqParams url.Values) (*url.URL, error) {
-	minioClient, err := minio.New(u.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, ""),
-		Secure: u.UseSSL,
-	})
+	minioClient, err := u.GetClient()
 	if minioClient == nil || err != nil {
 		return nil, fmt.Errorf("OssLoader bucket %v client not exist", bucket)
 	}
-	url, err := minioClient.PresignedGetObject(ctx, bucket, objectName, expiry, nil)
+	url, err := minioClient.PresignedGetObject(ctx, bucket, objectName, expiry, reqParams)
 	return url, err
 }
-func (u *OssLoader) DownLoadFile(ctx context.Context, bucket string, fileName string) (*minio.Object, error) {
-	minioClient, err := minio.New(u.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(u.AccessKeyID, u.SecretAccessKey, ""),
-		Secure: u.UseSSL,
-	})
+func (u *OssLoader) DownLoadFile(ctx context.Context, bucket string, fileName string) (ObjectReader, error) {
+	minioClient, err := u.GetClient()
 	if err != nil {
 		return nil, err
 	}
 	object, err := minioClient.GetObject(ctx, bucket, fileName, minio.GetObjectOptions{})
-	return object, err
+	if err != nil {
+		return nil, err
+	}
+	// Stat 失败(如对象不存在)时原样返回，由调用方的 Stat 处理
+	stat, err := object.Stat()
+	if err != nil {
+		return object, nil
+	}
+	return u.openObject(object, stat)
 }
-func QueryFileInfoFromSlqUrl(ctx context.Context, url string) ([]*Blog_file, error) {
-	var data = make([]*Blog_file, 0)
 
-	return data, nil
+// QueryFileInfoFromSlqUrl 使用 SetFileRepository 设置的仓库查询，未设置时返回空
+func QueryFileInfoFromSlqUrl(ctx context.Context, url string) ([]*Blog_file, error) {
+	if defaultFileRepository == nil {
+		return make([]*Blog_file, 0), nil
+	}
+	return defaultFileRepository.QueryByUrl(ctx, url)
 }
-func QueryFileInfoFromSlqHash(ctx context.Context, hash string) ([]*Blog_file, error) {
 
-	var data = make([]*Blog_file, 0)
-
-	return data, nil
+// QueryFileInfoFromSlqHash 使用 SetFileRepository 设置的仓库查询，未设置时返回空
+func QueryFileInfoFromSlqHash(ctx context.Context, hash string) ([]*Blog_file, error) {
+	if defaultFileRepository == nil {
+		return make([]*Blog_file, 0), nil
+	}
+	return defaultFileRepository.QueryByMd5(ctx, hash)
 }
 
+// UpdateFileToSql 使用 SetFileRepository 设置的仓库 upsert，未设置时原样返回
 func UpdateFileToSql(ctx context.Context, data *Blog_file) (*Blog_file, error) {
-
-	return data, nil
+	if defaultFileRepository == nil {
+		return data, nil
+	}
+	return defaultFileRepository.Upsert(ctx, data)
 }
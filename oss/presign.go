@@ -0,0 +1,429 @@
+package oss
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	SaveTypeMinio = "minio"
+
+	DefaultDirectUploadExpiry = 15 * time.Minute
+	// uploadTokenGrace 上传凭证比签名地址多出的有效期，留给客户端上传结束后上报
+	uploadTokenGrace = time.Hour
+)
+
+var ErrUploadToken = errors.New("upload token not valid")
+
+// uploadOwnerMeta 只限制前缀的 POST 直传把凭证的 owner 写入对象元数据，VerifyUploadComplete 据此确认对象是该凭证上传的
+const uploadOwnerMeta = "Upload-Owner"
+
+// DirectUploadPolicy 浏览器/App 直传 bucket 时的限制条件
+type DirectUploadPolicy struct {
+	Bucket       string
+	KeyPrefix    string        // 对象名必须以该前缀开头，如 article/1000/
+	ContentTypes []string      // 允许的 content-type，以 / 或 /* 结尾表示前缀匹配，如 image/*；为空表示不限制
+	MinSize      int64         // 最小字节数
+	MaxSize      int64         // 最大字节数，<=0 表示不限制
+	Expiry       time.Duration // 签名有效期，默认 DefaultDirectUploadExpiry
+	// TokenKey 签名上传凭证的密钥，必须配置；凭证把对象名和 owner 绑定，VerifyUploadComplete 只接受凭证中的对象
+	TokenKey []byte
+}
+
+// PresignedUpload 返回给客户端的直传信息
+type PresignedUpload struct {
+	Method     string            `json:"method"`              // PUT 或 POST
+	Url        string            `json:"url"`                 // 上传地址
+	FormData   map[string]string `json:"form_data,omitempty"` // POST 表单中需要原样带上的字段，file 字段放在最后
+	Headers    map[string]string `json:"headers,omitempty"`   // PUT 时需要原样带上的 header
+	Object     *Object           `json:"object"`
+	EncodedUrl string            `json:"encoded_url"` // 上传完成后用于保存的对象引用，格式同 EncodeRef
+	Token      string            `json:"token"`       // 上传完成后原样放在 UploadComplete.Token 中上报
+	ExpireAt   time.Time         `json:"expire_at"`
+}
+
+// uploadToken 上传凭证，Object 为空时只限制 Prefix
+type uploadToken struct {
+	Bucket   string `json:"b"`
+	Object   string `json:"o,omitempty"`
+	Prefix   string `json:"p,omitempty"`
+	Owner    string `json:"u,omitempty"`
+	IssuedAt int64  `json:"i"`
+	ExpireAt int64  `json:"e"`
+}
+
+// signUploadToken base64url(json).base64url(hmac_sha256)
+func (p *DirectUploadPolicy) signUploadToken(t *uploadToken) (string, error) {
+	if len(p.TokenKey) == 0 {
+		return "", fmt.Errorf("DirectUploadPolicy token key is empty")
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(refSign(p.TokenKey, payload)), nil
+}
+
+func (p *DirectUploadPolicy) parseUploadToken(s string) (*uploadToken, error) {
+	if len(p.TokenKey) == 0 {
+		return nil, fmt.Errorf("DirectUploadPolicy token key is empty")
+	}
+	i := strings.LastIndex(s, ".")
+	if i <= 0 {
+		return nil, ErrUploadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || !hmac.Equal(sig, refSign(p.TokenKey, s[:i])) {
+		return nil, ErrUploadToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return nil, ErrUploadToken
+	}
+	t := &uploadToken{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, ErrUploadToken
+	}
+	if time.Now().Unix() > t.ExpireAt {
+		return nil, errors.WithMessage(ErrUploadToken, "expired")
+	}
+	return t, nil
+}
+
+// newUploadToken 签发绑定对象和当前 owner 的凭证，owner 取 WithOwner 或 pmodel.GetCommonHeader 中的 uid
+func (p *DirectUploadPolicy) newUploadToken(ctx context.Context, objectName string, expireAt time.Time) (string, error) {
+	t := &uploadToken{
+		Bucket:   p.Bucket,
+		Object:   objectName,
+		Owner:    ownerFromCtx(ctx),
+		IssuedAt: time.Now().Unix(),
+		ExpireAt: expireAt.Add(uploadTokenGrace).Unix(),
+	}
+	if objectName == "" {
+		t.Prefix = p.KeyPrefix
+	}
+	return p.signUploadToken(t)
+}
+
+// owns 对象是否确定是用该凭证上传的，只限制前缀的凭证前缀是共享的，需要元数据中的 owner 一致
+func (t *uploadToken) owns(object string, stat minio.ObjectInfo) bool {
+	if t.Object != "" {
+		return object == t.Object
+	}
+	return t.Owner != "" && stat.UserMetadata[uploadOwnerMeta] == t.Owner
+}
+
+func (p *DirectUploadPolicy) expiry() time.Duration {
+	if p.Expiry <= 0 {
+		return DefaultDirectUploadExpiry
+	}
+	return p.Expiry
+}
+
+// IsContentTypeAllowed 判断 contentType 是否在白名单中
+func (p *DirectUploadPolicy) IsContentTypeAllowed(contentType string) bool {
+	return contentTypeAllowed(p.ContentTypes, contentType)
+}
+
+// contentTypeAllowed allows 为空表示不限制，以 / 或 /* 结尾表示前缀匹配
+func contentTypeAllowed(allows []string, contentType string) bool {
+	if len(allows) == 0 {
+		return true
+	}
+	contentType = baseContentType(contentType)
+	for _, allow := range allows {
+		allow = strings.ToLower(allow)
+		if strings.HasSuffix(allow, "/*") {
+			allow = strings.TrimSuffix(allow, "*")
+		}
+		if strings.HasSuffix(allow, "/") {
+			if strings.HasPrefix(contentType, allow) {
+				return true
+			}
+			continue
+		}
+		if contentType == allow {
+			return true
+		}
+	}
+	return false
+}
+
+// baseContentType 去掉 charset 等参数并转为小写
+func baseContentType(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+	return contentType
+}
+
+func (p *DirectUploadPolicy) check(objectName string, contentType string) error {
+	if p.Bucket == "" {
+		return fmt.Errorf("DirectUploadPolicy bucket is empty")
+	}
+	if objectName == "" || !strings.HasPrefix(objectName, p.KeyPrefix) {
+		return fmt.Errorf("object %v not match prefix %v", objectName, p.KeyPrefix)
+	}
+	if strings.Contains(objectName, "..") {
+		return fmt.Errorf("object %v not valid", objectName)
+	}
+	if !p.IsContentTypeAllowed(contentType) {
+		return fmt.Errorf("content type %v not allowed", contentType)
+	}
+	return nil
+}
+
+func (p *DirectUploadPolicy) checkSize(size int64) error {
+	if size < p.MinSize {
+		return fmt.Errorf("size %v less than %v", size, p.MinSize)
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return fmt.Errorf("size %v more than %v", size, p.MaxSize)
+	}
+	return nil
+}
+
+// PresignedPutObject 生成带 Content-Type 签名的 PUT 直传地址
+// PUT 方式无法在签名中限制大小，需要在上传完成后调用 VerifyUploadComplete 校验
+func (u *OssLoader) PresignedPutObject(ctx context.Context, policy DirectUploadPolicy, objectName string, contentType string) (*PresignedUpload, error) {
+	if err := policy.check(objectName, contentType); err != nil {
+		return nil, err
+	}
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	expiry := policy.expiry()
+	token, err := policy.newUploadToken(ctx, objectName, time.Now().Add(expiry))
+	if err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	if contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+	urlInfo, err := minioClient.PresignHeader(ctx, http.MethodPut, policy.Bucket, objectName, expiry, nil, headers)
+	if err != nil {
+		return nil, errors.WithMessage(err, "PresignedPutObject fail")
+	}
+	obj := NewObject(policy.Bucket, objectName)
+	res := &PresignedUpload{
+		Method:     http.MethodPut,
+		Url:        urlInfo.String(),
+		Headers:    map[string]string{},
+		Object:     obj,
+		EncodedUrl: u.EncodeRef(obj, 0),
+		Token:      token,
+		ExpireAt:   time.Now().Add(expiry),
+	}
+	for k := range headers {
+		res.Headers[k] = headers.Get(k)
+	}
+	return res, nil
+}
+
+// PresignedPostPolicy 生成 POST 表单直传策略，content-type、大小范围和对象名前缀都由存储端校验
+// objectName 为空时只限制前缀，由客户端在表单 key 字段中自行指定对象名
+func (u *OssLoader) PresignedPostPolicy(ctx context.Context, policy DirectUploadPolicy, objectName string, contentType string) (*PresignedUpload, error) {
+	checkName := objectName
+	if checkName == "" {
+		checkName = policy.KeyPrefix
+	}
+	if err := policy.check(checkName, contentType); err != nil {
+		return nil, err
+	}
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	expiry := policy.expiry()
+	expireAt := time.Now().Add(expiry)
+	token, err := policy.newUploadToken(ctx, objectName, expireAt)
+	if err != nil {
+		return nil, err
+	}
+	postPolicy := minio.NewPostPolicy()
+	if err := postPolicy.SetBucket(policy.Bucket); err != nil {
+		return nil, err
+	}
+	if objectName != "" {
+		err = postPolicy.SetKey(objectName)
+	} else {
+		err = postPolicy.SetKeyStartsWith(policy.KeyPrefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		if err := postPolicy.SetContentType(contentType); err != nil {
+			return nil, err
+		}
+	}
+	if owner := ownerFromCtx(ctx); objectName == "" && owner != "" {
+		if err := postPolicy.SetUserMetadata(uploadOwnerMeta, owner); err != nil {
+			return nil, err
+		}
+	}
+	maxSize := policy.MaxSize
+	if maxSize <= 0 {
+		// s3 单次 PUT 上限 5G
+		maxSize = 5 << 30
+	}
+	if err := postPolicy.SetContentLengthRange(policy.MinSize, maxSize); err != nil {
+		return nil, err
+	}
+	if err := postPolicy.SetExpires(expireAt.UTC()); err != nil {
+		return nil, err
+	}
+	urlInfo, formData, err := minioClient.PresignedPostPolicy(ctx, postPolicy)
+	if err != nil {
+		return nil, errors.WithMessage(err, "PresignedPostPolicy fail")
+	}
+	obj := NewObject(policy.Bucket, objectName)
+	res := &PresignedUpload{
+		Method:   http.MethodPost,
+		Url:      urlInfo.String(),
+		FormData: formData,
+		Object:   obj,
+		Token:    token,
+		ExpireAt: expireAt,
+	}
+	if objectName != "" {
+		res.EncodedUrl = u.EncodeRef(obj, 0)
+	}
+	return res, nil
+}
+
+// UploadComplete 客户端直传结束后上报的信息
+type UploadComplete struct {
+	Bucket   string
+	Object   string
+	Size     int64  // 客户端上传的字节数
+	Md5      string // 客户端计算的 md5 hex，为空不校验
+	Filename string // 原始文件名
+	Owner    string // 为空时使用凭证中的 owner，不为空时必须与凭证一致
+	Alt      string
+	Token    string // PresignedUpload.Token
+}
+
+// VerifyUploadComplete 校验直传的对象：先校验上传凭证，对象必须是凭证签发给该 owner 的，再 stat 对象检查大小、hash、policy 限制和配额
+// 服务端检查不通过且确认是该凭证上传的对象会被删除：凭证绑定了对象名，或只限制前缀时对象元数据中的 owner 与凭证一致
+// 其他情况以及客户端上报的大小、md5 不一致只返回错误，不删除对象；返回 EncodeRef 格式的引用
+func (u *OssLoader) VerifyUploadComplete(ctx context.Context, policy DirectUploadPolicy, req UploadComplete) (*Blog_file, string, error) {
+	token, err := policy.parseUploadToken(req.Token)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Bucket == "" {
+		req.Bucket = policy.Bucket
+	}
+	if req.Bucket != policy.Bucket || token.Bucket != policy.Bucket {
+		return nil, "", fmt.Errorf("bucket %v not match policy bucket %v", req.Bucket, policy.Bucket)
+	}
+	if token.Object != "" && req.Object != token.Object {
+		return nil, "", errors.WithMessage(ErrUploadToken, fmt.Sprintf("object %v not match", req.Object))
+	}
+	if token.Object == "" && (req.Object == "" || !strings.HasPrefix(req.Object, token.Prefix)) {
+		return nil, "", errors.WithMessage(ErrUploadToken, fmt.Sprintf("object %v not match prefix %v", req.Object, token.Prefix))
+	}
+	if req.Owner != "" && req.Owner != token.Owner {
+		return nil, "", errors.WithMessage(ErrUploadToken, fmt.Sprintf("owner %v not match", req.Owner))
+	}
+	req.Owner = token.Owner
+	minioClient, err := u.GetClient()
+	if err != nil {
+		return nil, "", err
+	}
+	stat, err := minioClient.StatObject(ctx, req.Bucket, req.Object, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "VerifyUploadComplete stat fail")
+	}
+	// 凭证签发之前已经存在的对象不是用该凭证上传的，不处理也不删除；留 1 分钟给存储端和本机的时钟误差
+	if stat.LastModified.Unix() < token.IssuedAt-60 {
+		return nil, "", errors.WithMessage(ErrUploadToken, fmt.Sprintf("object %v not uploaded with this token", req.Object))
+	}
+	verifyErr := policy.check(req.Object, stat.ContentType)
+	if verifyErr == nil {
+		verifyErr = policy.checkSize(stat.Size)
+	}
+	if verifyErr == nil {
+		verifyErr = u.CheckQuota(ctx, req.Owner, stat.Size)
+	}
+	if verifyErr != nil {
+		logs.CtxWarnf(ctx, "VerifyUploadComplete bucket=%v object=%v fail %v", req.Bucket, req.Object, verifyErr)
+		if !token.owns(req.Object, stat) {
+			return nil, "", verifyErr
+		}
+		if err := minioClient.RemoveObject(ctx, req.Bucket, req.Object, minio.RemoveObjectOptions{}); err != nil {
+			logs.CtxErrorf(ctx, "VerifyUploadComplete remove bucket=%v object=%v fail %v", req.Bucket, req.Object, err)
+		}
+		return nil, "", verifyErr
+	}
+	if req.Size > 0 && req.Size != stat.Size {
+		return nil, "", fmt.Errorf("size not match, client %v, stored %v", req.Size, stat.Size)
+	}
+	md5Hex, err := u.objectMd5(ctx, minioClient, req.Bucket, req.Object, stat)
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "VerifyUploadComplete md5 fail")
+	}
+	if req.Md5 != "" && !strings.EqualFold(req.Md5, md5Hex) {
+		return nil, "", fmt.Errorf("md5 not match, client %v, stored %v", req.Md5, md5Hex)
+	}
+	encodedUrl := u.objectRef(req.Bucket, req.Object)
+	filename := req.Filename
+	if filename == "" {
+		filename = req.Object[strings.LastIndex(req.Object, "/")+1:]
+	}
+	file := &Blog_file{
+		Filename:    filename,
+		ContentType: stat.ContentType,
+		Owner:       req.Owner,
+		Url:         encodedUrl,
+		Path:        req.Object,
+		Bucket:      req.Bucket,
+		Alt:         req.Alt,
+		Md5:         md5Hex,
+		Prefix:      policy.KeyPrefix,
+		MinioKey:    req.Object,
+		SaveType:    SaveTypeMinio,
+		Size:        stat.Size,
+	}
+	saved, err := u.saveFile(ctx, file)
+	if err != nil {
+		return nil, "", err
+	}
+	return saved, encodedUrl, nil
+}
+
+// objectMd5 单次上传的对象 ETag 就是 md5，分片上传的 ETag 带 -N 后缀，需要读出内容重新计算
+func (u *OssLoader) objectMd5(ctx context.Context, minioClient *minio.Client, bucket string, object string, stat minio.ObjectInfo) (string, error) {
+	etag := strings.Trim(stat.ETag, "\"")
+	if len(etag) == 32 && !strings.Contains(etag, "-") {
+		return strings.ToLower(etag), nil
+	}
+	reader, err := minioClient.GetObject(ctx, bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
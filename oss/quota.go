@@ -0,0 +1,331 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/paerospike"
+	"github.com/EICHI-X/ptools/putils"
+	aerospike "github.com/aerospike/aerospike-client-go/v6"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultQuotaTier = "default"
+
+	usageBytesBin   = "bytes"
+	usageObjectsBin = "objects"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Usage owner 已使用的字节数和对象数
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// QuotaLimit 某个等级的配额，0 表示不限制
+type QuotaLimit struct {
+	MaxBytes   int64 `json:"max_bytes"`
+	MaxObjects int64 `json:"max_objects"`
+}
+
+// UsageStore 用量计数，Incr 必须是原子操作，返回变更后的用量
+type UsageStore interface {
+	Incr(ctx context.Context, owner string, bytes int64, objects int64) (Usage, error)
+	Get(ctx context.Context, owner string) (Usage, error)
+	Set(ctx context.Context, owner string, usage Usage) error
+}
+
+// MemoryUsageStore 进程内的 UsageStore，用于测试或单机
+type MemoryUsageStore struct {
+	mu     sync.Mutex
+	usages map[string]Usage
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{usages: map[string]Usage{}}
+}
+
+func (s *MemoryUsageStore) Incr(ctx context.Context, owner string, bytes int64, objects int64) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usages[owner]
+	usage.Bytes += bytes
+	usage.Objects += objects
+	s.usages[owner] = usage
+	return usage, nil
+}
+
+func (s *MemoryUsageStore) Get(ctx context.Context, owner string) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usages[owner], nil
+}
+
+func (s *MemoryUsageStore) Set(ctx context.Context, owner string, usage Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usages[owner] = usage
+	return nil
+}
+
+// AerospikeUsageStore 基于 aerospike 原子加的 UsageStore，字节数和对象数保存在同一条记录的两个 bin 中
+type AerospikeUsageStore struct {
+	Client     *paerospike.Client
+	KeyPattern string // 格式必须是 appid|project|key，默认 1000|oss|usage.%v
+}
+
+func NewAerospikeUsageStore(psm string) *AerospikeUsageStore {
+	return &AerospikeUsageStore{
+		Client:     paerospike.NewDefaultClient(psm),
+		KeyPattern: "1000|oss|usage.%v",
+	}
+}
+
+func (s *AerospikeUsageStore) operate(owner string, ops ...*aerospike.Operation) (Usage, error) {
+	if s.Client == nil {
+		return Usage{}, fmt.Errorf("AerospikeUsageStore client is nil")
+	}
+	ops = append(ops, aerospike.GetBinOp(usageBytesBin), aerospike.GetBinOp(usageObjectsBin))
+	r, err := s.Client.Operate(fmt.Sprintf(s.KeyPattern, owner), ops, 0, nil)
+	if err != nil || r == nil {
+		return Usage{}, errors.WithMessage(err, "AerospikeUsageStore operate fail")
+	}
+	return Usage{Bytes: binInt64(r.Bins[usageBytesBin]), Objects: binInt64(r.Bins[usageObjectsBin])}, nil
+}
+
+func (s *AerospikeUsageStore) Incr(ctx context.Context, owner string, bytes int64, objects int64) (Usage, error) {
+	return s.operate(owner,
+		aerospike.AddOp(aerospike.NewBin(usageBytesBin, bytes)),
+		aerospike.AddOp(aerospike.NewBin(usageObjectsBin, objects)))
+}
+
+func (s *AerospikeUsageStore) Get(ctx context.Context, owner string) (Usage, error) {
+	usage, err := s.operate(owner)
+	if err != nil && errors.Is(err, aerospike.ErrKeyNotFound) {
+		return Usage{}, nil
+	}
+	return usage, err
+}
+
+func (s *AerospikeUsageStore) Set(ctx context.Context, owner string, usage Usage) error {
+	_, err := s.operate(owner,
+		aerospike.PutOp(aerospike.NewBin(usageBytesBin, usage.Bytes)),
+		aerospike.PutOp(aerospike.NewBin(usageObjectsBin, usage.Objects)))
+	return err
+}
+
+func binInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
+
+// Quota 按 owner 统计用量并按等级限制，上传成功后 OssLoader.saveFile 增加用量，SoftDeleteFile、RemoveObject 等删除时扣减
+// 上传前的检查和计数不是同一个原子操作，并发上传时可能略微超出配额
+type Quota struct {
+	Store       UsageStore
+	Tiers       map[string]QuotaLimit // 等级 => 配额
+	DefaultTier string                // TierOf 为空或返回的等级不存在时使用，默认 DefaultQuotaTier
+	// TierOf 返回 owner 的等级，如从会员信息中查询
+	TierOf func(ctx context.Context, owner string) string
+}
+
+func NewQuota(store UsageStore, tiers map[string]QuotaLimit) *Quota {
+	if store == nil {
+		store = NewMemoryUsageStore()
+	}
+	return &Quota{Store: store, Tiers: tiers, DefaultTier: DefaultQuotaTier}
+}
+
+// WithQuota 按 owner 统计用量，上传前检查配额，见 Quota
+func WithQuota(q *Quota) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Quota = q
+	}
+}
+
+// Limit owner 所在等级的配额，没有配置时不限制
+func (q *Quota) Limit(ctx context.Context, owner string) QuotaLimit {
+	if q.TierOf != nil {
+		if limit, ok := q.Tiers[q.TierOf(ctx, owner)]; ok {
+			return limit
+		}
+	}
+	tier := q.DefaultTier
+	if tier == "" {
+		tier = DefaultQuotaTier
+	}
+	return q.Tiers[tier]
+}
+
+func (q *Quota) Usage(ctx context.Context, owner string) (Usage, error) {
+	return q.Store.Get(ctx, owner)
+}
+
+// Check 再增加 bytes 字节、objects 个对象是否超出配额，超出时返回 ErrQuotaExceeded
+// bytes 小于 0 表示大小未知，只检查已有用量
+func (q *Quota) Check(ctx context.Context, owner string, bytes int64, objects int64) error {
+	limit := q.Limit(ctx, owner)
+	if limit.MaxBytes <= 0 && limit.MaxObjects <= 0 {
+		return nil
+	}
+	usage, err := q.Store.Get(ctx, owner)
+	if err != nil {
+		return errors.WithMessage(err, "get usage fail")
+	}
+	if bytes < 0 {
+		bytes = 0
+	}
+	if limit.MaxBytes > 0 && usage.Bytes+bytes > limit.MaxBytes {
+		return errors.WithMessage(ErrQuotaExceeded, fmt.Sprintf("owner %v used %v bytes, limit %v", owner, usage.Bytes, limit.MaxBytes))
+	}
+	if limit.MaxObjects > 0 && usage.Objects+objects > limit.MaxObjects {
+		return errors.WithMessage(ErrQuotaExceeded, fmt.Sprintf("owner %v used %v objects, limit %v", owner, usage.Objects, limit.MaxObjects))
+	}
+	return nil
+}
+
+// addUsage 计数失败只打日志，由 QuotaReconcileJob 修正
+func (q *Quota) addUsage(ctx context.Context, owner string, bytes int64, objects int64) {
+	if q == nil || owner == "" {
+		return
+	}
+	if _, err := q.Store.Incr(ctx, owner, bytes, objects); err != nil {
+		logs.CtxWarnf(ctx, "Quota add usage owner=%v bytes=%v fail %v", owner, bytes, err)
+	}
+}
+
+// Reconcile 按元数据表重新计算所有 owner 的用量，返回更新的 owner 数
+// 计算期间的上传和删除可能被覆盖，建议在低峰期执行
+func (q *Quota) Reconcile(ctx context.Context, repo *FileRepository) (int, error) {
+	usages, err := repo.UsageByOwner(ctx)
+	if err != nil {
+		return 0, errors.WithMessage(err, "Reconcile query usage fail")
+	}
+	count := 0
+	for _, usage := range usages {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		if err := q.Store.Set(ctx, usage.Owner, Usage{Bytes: usage.Bytes, Objects: usage.Objects}); err != nil {
+			logs.CtxWarnf(ctx, "Reconcile owner=%v fail %v", usage.Owner, err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// CheckQuota 上传前检查配额，owner 为空时取 WithOwner 或 pmodel.GetCommonHeader 中的 uid，仍为空或未配置 Quota 时不检查
+func (u *OssLoader) CheckQuota(ctx context.Context, owner string, size int64) error {
+	return u.CheckQuotaN(ctx, owner, size, 1)
+}
+
+// CheckQuotaN 一次上传 objects 个文件、共 bytes 字节前检查配额，owner 规则同 CheckQuota
+func (u *OssLoader) CheckQuotaN(ctx context.Context, owner string, bytes int64, objects int64) error {
+	if u.Quota == nil {
+		return nil
+	}
+	if owner == "" {
+		owner = ownerFromCtx(ctx)
+	}
+	if owner == "" {
+		return nil
+	}
+	return u.Quota.Check(ctx, owner, bytes, objects)
+}
+
+// QuotaReconcileJob 定期按元数据表修正用量，Loader 不为空时先按对象大小补齐 size 为 0 的记录
+type QuotaReconcileJob struct {
+	Quota     *Quota
+	Repo      *FileRepository
+	Loader    *OssLoader
+	BatchSize int // 每次补齐的记录数，默认 500
+	Interval  time.Duration
+}
+
+func (j *QuotaReconcileJob) RunOnce(ctx context.Context) error {
+	if j.Loader != nil {
+		if err := j.backfillSize(ctx); err != nil {
+			logs.CtxWarnf(ctx, "QuotaReconcileJob backfill size fail %v", err)
+		}
+	}
+	count, err := j.Quota.Reconcile(ctx, j.Repo)
+	if err != nil {
+		return err
+	}
+	logs.CtxInfof(ctx, "QuotaReconcileJob reconciled %v owners", count)
+	return nil
+}
+
+func (j *QuotaReconcileJob) backfillSize(ctx context.Context) error {
+	minioClient, err := j.Loader.GetClient()
+	if err != nil {
+		return err
+	}
+	batchSize := j.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	var lastId int64
+	for ctx.Err() == nil {
+		files, err := j.Repo.ListWithoutSize(ctx, lastId, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			lastId = f.ID
+			if f.Bucket == "" || f.MinioKey == "" {
+				continue
+			}
+			stat, err := minioClient.StatObject(ctx, f.Bucket, f.MinioKey, minio.StatObjectOptions{})
+			if err != nil || stat.Size <= 0 {
+				continue
+			}
+			if err := j.Repo.UpdateSize(ctx, f.ID, stat.Size); err != nil {
+				logs.CtxWarnf(ctx, "QuotaReconcileJob update size id=%v fail %v", f.ID, err)
+			}
+		}
+		if len(files) < batchSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// Start 启动后立即执行一次，之后每隔 Interval 执行，默认每天一次
+func (j *QuotaReconcileJob) Start(ctx context.Context) {
+	interval := j.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			putils.GoFuncDone(ctx, wg, nil, func(ctx context.Context, param interface{}) {
+				if err := j.RunOnce(ctx); err != nil {
+					logs.CtxErrorf(ctx, "QuotaReconcileJob fail %v", err)
+				}
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,245 @@
+package oss
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/purl"
+	"github.com/pkg/errors"
+)
+
+// RefPrefixV1 第一版文件引用格式：oref:v1:<base64url(json)>.<base64url(hmac_sha256)>，签名内容为最后一个 . 之前的部分
+const RefPrefixV1 = "oref:v1:"
+
+const (
+	RefFormatV1       = "v1"
+	RefFormatObject   = "ostart"   // 旧格式 ostart:<base64 json>:oend
+	RefFormatFileInfo = "fileinfo" // 旧格式 base64(purl.FileInfo json)
+
+	DefaultRefUrlExpiry = time.Hour // ResolveRef 签名地址的有效期
+)
+
+var (
+	ErrNotRef              = errors.New("not a file reference")
+	ErrRefSignature        = errors.New("file reference signature not valid")
+	ErrRefExpired          = errors.New("file reference expired")
+	ErrRefLegacyNotAllowed = errors.New("legacy file reference not allowed")
+)
+
+// FileRef 统一的文件引用，Bucket/Object 为空时 URL 为可直接访问的地址
+type FileRef struct {
+	Bucket      string `json:"b,omitempty"`
+	Object      string `json:"o,omitempty"`
+	Host        string `json:"h,omitempty"`
+	URL         string `json:"u,omitempty"`
+	FileName    string `json:"n,omitempty"`
+	ContentType string `json:"t,omitempty"`
+	Size        int64  `json:"s,omitempty"`
+	IsPublic    bool   `json:"p,omitempty"`
+	ExpireAt    int64  `json:"e,omitempty"` // unix 秒，0 表示不过期
+
+	Format string `json:"-"` // 解析出的格式，RefFormatXxx
+}
+
+// ToObject 引用的对象，URL 形式的引用返回 nil
+func (r *FileRef) ToObject() *Object {
+	if r.Bucket == "" || r.Object == "" {
+		return nil
+	}
+	o := NewObject(r.Bucket, r.Object)
+	o.Host = r.Host
+	return o
+}
+
+// RefCodec 文件引用的编解码，Key 用于签名，OldKeys 只用于校验，便于轮换
+// AllowLegacy 为 true 时接受未签名的旧格式，旧格式只能引用 LegacyBuckets 中的 bucket，默认都不接受
+type RefCodec struct {
+	Key           []byte
+	OldKeys       [][]byte
+	AllowLegacy   bool
+	LegacyBuckets []string
+}
+
+func NewRefCodec(key []byte, oldKeys ...[]byte) *RefCodec {
+	return &RefCodec{Key: key, OldKeys: oldKeys}
+}
+
+func WithRefCodec(c *RefCodec) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.Refs = c
+	}
+}
+
+func refSign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode 编码并签名，没有配置 Key 时返回错误
+func (c *RefCodec) Encode(ref *FileRef) (string, error) {
+	if c == nil || len(c.Key) == 0 {
+		return "", fmt.Errorf("RefCodec key is empty")
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return "", err
+	}
+	payload := RefPrefixV1 + base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(refSign(c.Key, payload)), nil
+}
+
+// EncodeObject 编码对象引用，ttl <=0 表示不过期
+func (c *RefCodec) EncodeObject(o *Object, ttl time.Duration) (string, error) {
+	ref := &FileRef{Bucket: o.Bucket, Object: o.Object, Host: o.Host}
+	if ttl > 0 {
+		ref.ExpireAt = time.Now().Add(ttl).Unix()
+	}
+	return c.Encode(ref)
+}
+
+// Decode 解析 v1 和两种旧格式，无法识别时返回 ErrNotRef
+func (c *RefCodec) Decode(s string) (*FileRef, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, RefPrefixV1) {
+		return c.decodeV1(s)
+	}
+	ref, err := decodeLegacyRef(s)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || !c.AllowLegacy {
+		return nil, ErrRefLegacyNotAllowed
+	}
+	if ref.Bucket != "" && !containsStr(c.LegacyBuckets, ref.Bucket) {
+		return nil, errors.WithMessage(ErrRefLegacyNotAllowed, ref.Bucket)
+	}
+	return ref, nil
+}
+
+func (c *RefCodec) decodeV1(s string) (*FileRef, error) {
+	i := strings.LastIndex(s, ".")
+	if i < len(RefPrefixV1) {
+		return nil, ErrRefSignature
+	}
+	payload := s[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || c == nil {
+		return nil, ErrRefSignature
+	}
+	valid := false
+	for _, key := range append([][]byte{c.Key}, c.OldKeys...) {
+		if len(key) > 0 && hmac.Equal(sig, refSign(key, payload)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrRefSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload[len(RefPrefixV1):])
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode file reference fail")
+	}
+	ref := &FileRef{}
+	if err := json.Unmarshal(data, ref); err != nil {
+		return nil, errors.WithMessage(err, "decode file reference fail")
+	}
+	if ref.ExpireAt > 0 && time.Now().Unix() > ref.ExpireAt {
+		return nil, ErrRefExpired
+	}
+	ref.Format = RefFormatV1
+	return ref, nil
+}
+
+// decodeLegacyRef 解析 ostart:...:oend 和 base64 的 purl.FileInfo
+func decodeLegacyRef(s string) (*FileRef, error) {
+	if IsOssUrlEncodedUrl(s) {
+		o, err := DecodeUrlToObject(s)
+		if err != nil {
+			return nil, err
+		}
+		return &FileRef{Bucket: o.Bucket, Object: o.Object, Host: o.Host, Format: RefFormatObject}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrNotRef
+	}
+	info := purl.FileInfo{}
+	if err := json.Unmarshal(data, &info); err != nil || (info.URL == "" && info.FilePath == "") {
+		return nil, ErrNotRef
+	}
+	ref := &FileRef{
+		URL:         info.URL,
+		FileName:    info.FileName,
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		IsPublic:    info.IsPublic,
+		Format:      RefFormatFileInfo,
+	}
+	// URL 是 ostart 编码时以其中的对象为准，否则按 FilePath bucket/object 解析
+	if inner, err := decodeLegacyRef(info.URL); err == nil && inner.Format == RefFormatObject {
+		ref.Bucket, ref.Object, ref.Host, ref.URL = inner.Bucket, inner.Object, inner.Host, ""
+	} else if !isHttpUrl(info.URL) {
+		if i := strings.Index(info.FilePath, "/"); i > 0 {
+			ref.Bucket, ref.Object = info.FilePath[:i], info.FilePath[i+1:]
+		}
+	}
+	return ref, nil
+}
+
+// refCodec 未配置时只接受引用 CDN 公开 bucket 的旧格式，私有 bucket 需要配置 RefCodec 使用签名引用
+func (u *OssLoader) refCodec() *RefCodec {
+	if u.Refs != nil {
+		return u.Refs
+	}
+	c := &RefCodec{AllowLegacy: true}
+	if u.Cdn != nil {
+		c.LegacyBuckets = u.Cdn.Buckets
+	}
+	return c
+}
+
+// EncodeRef 对外返回的对象引用，配置了 RefCodec 且有 Key 时使用签名的 v1 格式，否则使用旧的 EncodeUrl
+// 旧格式解析时只接受 LegacyBuckets 中的 bucket，其他 bucket 的旧格式引用无法被同一个 OssLoader 解析，会输出错误日志
+func (u *OssLoader) EncodeRef(o *Object, ttl time.Duration) string {
+	if u.Refs != nil && len(u.Refs.Key) > 0 {
+		s, err := u.Refs.EncodeObject(o, ttl)
+		if err == nil {
+			return s
+		}
+		logs.Errorf("EncodeRef bucket=%v object=%v fail %v", o.Bucket, o.Object, err)
+	}
+	if c := u.refCodec(); !c.AllowLegacy || !containsStr(c.LegacyBuckets, o.Bucket) {
+		logs.Errorf("EncodeRef bucket %v is not public and RefCodec key is empty, reference can not be resolved, use WithRefCodec", o.Bucket)
+	}
+	return o.EncodeUrl()
+}
+
+// objectRef 对象的长期引用，元数据记录的 Url 与返回给客户端的引用一致，便于按引用查询记录
+func (u *OssLoader) objectRef(bucket string, key string) string {
+	return u.EncodeRef(NewObject(bucket, key), 0)
+}
+
+// checkRefs RefCodec 没有 Key 时只能解析旧格式，旧格式不被接受时生成的引用都无法解析
+func (u *OssLoader) checkRefs() error {
+	if u.Refs != nil && len(u.Refs.Key) == 0 && !u.Refs.AllowLegacy {
+		return fmt.Errorf("RefCodec key is empty and legacy reference not allowed")
+	}
+	if u.Refs == nil || len(u.Refs.Key) == 0 {
+		logs.Errorf("OssLoader RefCodec key is empty, references to private buckets can not be resolved, use WithRefCodec")
+	}
+	return nil
+}
+
+// ResolveRef 把三种格式的引用解析为可访问的地址，实现 purl.RefResolver
+func (u *OssLoader) ResolveRef(ctx context.Context, s string) (string, error) {
+	return u.GetRealUrlFromEncodedUrl(ctx, s, DefaultRefUrlExpiry)
+}
@@ -0,0 +1,73 @@
+package oss
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EICHI-X/ptools/purl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefCodecV1(t *testing.T) {
+	codec := NewRefCodec([]byte("key-1"))
+	ref, err := codec.EncodeObject(NewObject("private", "a/b.jpg"), time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(ref, RefPrefixV1))
+
+	decoded, err := codec.Decode(ref)
+	assert.Nil(t, err)
+	assert.Equal(t, RefFormatV1, decoded.Format)
+	assert.Equal(t, "private", decoded.Bucket)
+	assert.Equal(t, "a/b.jpg", decoded.Object)
+
+	// 修改内容后签名校验失败
+	tampered, _ := NewRefCodec([]byte("other")).EncodeObject(NewObject("private", "c.jpg"), 0)
+	payload := tampered[:strings.LastIndex(tampered, ".")]
+	_, err = codec.Decode(payload + ref[strings.LastIndex(ref, "."):])
+	assert.Equal(t, ErrRefSignature, err)
+
+	// 旧 key 轮换后仍可校验
+	rotated := NewRefCodec([]byte("key-2"), []byte("key-1"))
+	_, err = rotated.Decode(ref)
+	assert.Nil(t, err)
+
+	expired, _ := codec.Encode(&FileRef{Bucket: "private", Object: "a", ExpireAt: time.Now().Add(-time.Minute).Unix()})
+	_, err = codec.Decode(expired)
+	assert.Equal(t, ErrRefExpired, err)
+}
+
+func TestRefCodecLegacy(t *testing.T) {
+	codec := NewRefCodec([]byte("key-1"))
+	// 默认不接受旧格式
+	_, err := codec.Decode(NewObject("public", "x.png").EncodeUrl())
+	assert.Equal(t, ErrRefLegacyNotAllowed, err)
+
+	codec.AllowLegacy = true
+	_, err = codec.Decode(NewObject("public", "x.png").EncodeUrl())
+	assert.NotNil(t, err)
+
+	codec.LegacyBuckets = []string{"public"}
+	decoded, err := codec.Decode(NewObject("public", "x.png").EncodeUrl())
+	assert.Nil(t, err)
+	assert.Equal(t, RefFormatObject, decoded.Format)
+	assert.Equal(t, "x.png", decoded.Object)
+
+	info, _ := purl.EncodeFileInfo(&purl.FileInfo{FileName: "x.png", FilePath: "public/dir/x.png"})
+	decoded, err = codec.Decode(info)
+	assert.Nil(t, err)
+	assert.Equal(t, RefFormatFileInfo, decoded.Format)
+	assert.Equal(t, "public", decoded.Bucket)
+	assert.Equal(t, "dir/x.png", decoded.Object)
+
+	_, err = codec.Decode(NewObject("private", "x.png").EncodeUrl())
+	assert.NotNil(t, err)
+
+	codec.AllowLegacy = false
+	_, err = codec.Decode(NewObject("public", "x.png").EncodeUrl())
+	assert.Equal(t, ErrRefLegacyNotAllowed, err)
+
+	_, err = codec.Decode(base64.StdEncoding.EncodeToString([]byte("hello")))
+	assert.Equal(t, ErrNotRef, err)
+}
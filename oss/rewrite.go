@@ -0,0 +1,396 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+const (
+	RewriteFormatHTML     = "html"
+	RewriteFormatMarkdown = "markdown"
+)
+
+// rewriteAttrs 会被替换引用的属性，srcset 单独按候选项解析
+var rewriteAttrs = map[string]bool{"src": true, "href": true, "poster": true, "data-src": true, "data-original": true}
+
+// markdown 引用定义 [id]: <dest> "title"
+var mdRefDefRegexp = regexp.MustCompile(`(?m)^ {0,3}\[[^\]\n]+\]:[ \t]*<?([^\s>]+)`)
+
+// RewriteOption 文章内容引用替换的参数
+type RewriteOption struct {
+	Format    string        // RewriteFormatHTML 或 RewriteFormatMarkdown，默认 html
+	Expiry    time.Duration // 签名地址有效期，默认 DefaultRefUrlExpiry
+	RetryTime int
+	// Srcset 不为空时为引用对象的 img 增加 srcset，宽度取 MaxWidth
+	// 变体按 VariantKey(对象名, Name, "") 拼接，只对上传时生成了这些变体的图片开启
+	Srcset []ImageVariant
+}
+
+// RewriteRefs 把 HTML/Markdown 中的文件引用替换为可访问的地址，见 RewriteRefsBatch
+func (u *OssLoader) RewriteRefs(ctx context.Context, content string, opt RewriteOption) (string, []error) {
+	res, errs := u.RewriteRefsBatch(ctx, []string{content}, opt)
+	return res[0], errs
+}
+
+// RewriteRefsBatch 收集所有内容中的 ostart、oref:v1 和 FileInfo 引用，通过一次 GetRealUrlsWithCache 解析后替换回去
+// 只改写引用本身，其余内容原样保留；Markdown 中代码块和行内代码不处理
+// 解析失败的引用保持原样，错误去重后返回
+func (u *OssLoader) RewriteRefsBatch(ctx context.Context, contents []string, opt RewriteOption) ([]string, []error) {
+	if opt.Expiry <= 0 {
+		opt.Expiry = DefaultRefUrlExpiry
+	}
+	markdown := opt.Format == RewriteFormatMarkdown
+
+	// 第一遍只收集引用
+	refs := make([]string, 0)
+	refIdx := map[string]int{}
+	collect := func(ref string) {
+		if _, ok := refIdx[ref]; !ok {
+			refIdx[ref] = len(refs)
+			refs = append(refs, ref)
+		}
+	}
+	variantRefs := map[string][]string{}
+	for _, content := range contents {
+		rewriteContent(content, markdown, func(ref string) (string, bool) {
+			collect(ref)
+			return "", false
+		}, func(src string) string {
+			if _, ok := variantRefs[src]; ok || len(opt.Srcset) == 0 {
+				return ""
+			}
+			variantRefs[src] = u.variantRefs(src, opt.Srcset)
+			for _, ref := range variantRefs[src] {
+				if ref != "" {
+					collect(ref)
+				}
+			}
+			return ""
+		})
+	}
+	res := make([]string, len(contents))
+	if len(refs) == 0 {
+		copy(res, contents)
+		return res, nil
+	}
+
+	realUrls, urlErrs := u.GetRealUrlsWithCache(ctx, refs, opt.Expiry, opt.RetryTime)
+	var errs []error
+	for i, err := range urlErrs {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rewrite ref %v fail %w", refs[i], err))
+		}
+	}
+	resolve := func(ref string) (string, bool) {
+		i, ok := refIdx[ref]
+		if !ok || urlErrs[i] != nil || realUrls[i] == "" {
+			return "", false
+		}
+		return realUrls[i], true
+	}
+	for i, content := range contents {
+		res[i] = rewriteContent(content, markdown, resolve, func(src string) string {
+			candidates := make([]string, 0, len(opt.Srcset))
+			for j, ref := range variantRefs[src] {
+				if ref == "" {
+					continue
+				}
+				if realUrl, ok := resolve(ref); ok {
+					candidates = append(candidates, fmt.Sprintf("%v %dw", realUrl, opt.Srcset[j].MaxWidth))
+				}
+			}
+			return strings.Join(candidates, ", ")
+		})
+	}
+	return res, errs
+}
+
+// variantRefs 与 variants 一一对应的变体引用，无法生成时对应位置为空
+func (u *OssLoader) variantRefs(src string, variants []ImageVariant) []string {
+	object, _, err := u.decodeRef(src)
+	if err != nil || object == nil {
+		return nil
+	}
+	res := make([]string, len(variants))
+	for i, v := range variants {
+		if v.Name == "" || v.MaxWidth <= 0 {
+			continue
+		}
+		variant := NewObject(object.Bucket, VariantKey(object.Object, v.Name, ""))
+		variant.Host = object.Host
+		res[i] = u.EncodeRef(variant, 0)
+	}
+	return res
+}
+
+// isRefLike 只根据格式判断是否是文件引用，签名和权限在解析时校验
+func isRefLike(s string) bool {
+	if s == "" || isHttpUrl(s) {
+		return false
+	}
+	if strings.HasPrefix(s, RefPrefixV1) || IsOssUrlEncodedUrl(s) {
+		return true
+	}
+	_, err := decodeLegacyRef(s)
+	return err == nil
+}
+
+// rewriteContent 遍历内容中的引用，resolve 返回 false 时保持原样
+// srcset 对没有 srcset 属性、src 为引用的 img 返回需要增加的 srcset，为空表示不增加
+func rewriteContent(content string, markdown bool, resolve func(ref string) (string, bool), srcset func(src string) string) string {
+	if !markdown {
+		return rewriteHTML(content, false, resolve, srcset)
+	}
+	var b strings.Builder
+	for _, seg := range splitMarkdownCode(content) {
+		if seg.code {
+			b.WriteString(seg.text)
+			continue
+		}
+		b.WriteString(rewriteHTML(seg.text, true, resolve, srcset))
+	}
+	return b.String()
+}
+
+// rewriteHTML 逐个 token 输出原始内容，只改写标签中引用所在的属性值；markdown 为 true 时文本部分按 markdown 链接处理
+// 结尾不完整的标签等无法解析的部分原样输出
+func rewriteHTML(content string, markdown bool, resolve func(ref string) (string, bool), srcset func(src string) string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(content))
+	pos := 0 // 已经输出的原始内容的长度，token 的 Raw 是连续的
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			b.WriteString(content[pos:])
+			break
+		}
+		raw := string(z.Raw())
+		pos += len(raw)
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			raw = rewriteTag(z, raw, resolve, srcset)
+		case xhtml.TextToken:
+			if markdown {
+				raw = rewriteMarkdownLinks(raw, resolve)
+			}
+		}
+		b.WriteString(raw)
+	}
+	return b.String()
+}
+
+func rewriteTag(z *xhtml.Tokenizer, raw string, resolve func(ref string) (string, bool), srcset func(src string) string) string {
+	name, hasAttr := z.TagName()
+	var refs []string
+	src := ""
+	hasSrcset := false
+	for hasAttr {
+		var key, val []byte
+		key, val, hasAttr = z.TagAttr()
+		attr, value := string(key), strings.TrimSpace(string(val))
+		switch {
+		case attr == "srcset":
+			hasSrcset = true
+			for _, candidate := range strings.Split(value, ",") {
+				if fields := strings.Fields(candidate); len(fields) > 0 && isRefLike(fields[0]) {
+					refs = append(refs, fields[0])
+				}
+			}
+		case rewriteAttrs[attr] && isRefLike(value):
+			refs = append(refs, value)
+			if attr == "src" {
+				src = value
+			}
+		}
+	}
+	for _, ref := range refs {
+		if realUrl, ok := resolve(ref); ok {
+			raw = strings.ReplaceAll(raw, ref, xhtml.EscapeString(realUrl))
+		}
+	}
+	if string(name) == "img" && src != "" && !hasSrcset {
+		if value := srcset(src); value != "" {
+			raw = insertAttr(raw, fmt.Sprintf(" srcset=\"%v\"", xhtml.EscapeString(value)))
+		}
+	}
+	return raw
+}
+
+// insertAttr 在标签结尾的 > 或 /> 之前插入属性
+func insertAttr(raw string, attr string) string {
+	end := len(raw) - len(">")
+	if strings.HasSuffix(raw, "/>") {
+		end = len(raw) - len("/>")
+	}
+	if end < 0 || !strings.HasSuffix(raw, ">") {
+		return raw
+	}
+	return raw[:end] + attr + raw[end:]
+}
+
+// rewriteMarkdownLinks 改写 ](dest "title") 和 [id]: dest 中的 dest
+func rewriteMarkdownLinks(text string, resolve func(ref string) (string, bool)) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, "](")
+		if i < 0 {
+			break
+		}
+		b.WriteString(text[:i+2])
+		text = text[i+2:]
+		start, end := markdownDest(text)
+		if dest := text[start:end]; isRefLike(dest) {
+			if realUrl, ok := resolve(dest); ok {
+				b.WriteString(text[:start])
+				b.WriteString(realUrl)
+				text = text[end:]
+			}
+		}
+	}
+	b.WriteString(text)
+
+	return mdRefDefRegexp.ReplaceAllStringFunc(b.String(), func(line string) string {
+		m := mdRefDefRegexp.FindStringSubmatch(line)
+		if len(m) < 2 || !isRefLike(m[1]) {
+			return line
+		}
+		realUrl, ok := resolve(m[1])
+		if !ok {
+			return line
+		}
+		return strings.TrimSuffix(line, m[1]) + realUrl
+	})
+}
+
+// markdownDest 返回链接地址在 s 中的位置，s 为 ]( 之后的内容
+func markdownDest(s string) (int, int) {
+	start := 0
+	for start < len(s) && (s[start] == ' ' || s[start] == '\t') {
+		start++
+	}
+	if start < len(s) && s[start] == '<' {
+		if end := strings.IndexAny(s[start+1:], ">\n"); end >= 0 {
+			return start + 1, start + 1 + end
+		}
+		return start, start
+	}
+	end := start
+	depth := 0
+	for end < len(s) {
+		c := s[end]
+		if c == ' ' || c == '\t' || c == '\n' || (c == ')' && depth == 0) {
+			break
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+		}
+		end++
+	}
+	return start, end
+}
+
+type markdownSegment struct {
+	text string
+	code bool
+}
+
+// splitMarkdownCode 按围栏代码块和行内代码切分，code 部分不做任何改写
+func splitMarkdownCode(content string) []markdownSegment {
+	var res []markdownSegment
+	var text strings.Builder
+	flushText := func() {
+		if text.Len() > 0 {
+			res = append(res, splitInlineCode(text.String())...)
+			text.Reset()
+		}
+	}
+	lines := strings.SplitAfter(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		fence := markdownFence(lines[i])
+		if fence == "" {
+			text.WriteString(lines[i])
+			continue
+		}
+		flushText()
+		var code strings.Builder
+		code.WriteString(lines[i])
+		for i++; i < len(lines); i++ {
+			code.WriteString(lines[i])
+			if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				break
+			}
+		}
+		res = append(res, markdownSegment{text: code.String(), code: true})
+	}
+	flushText()
+	return res
+}
+
+// markdownFence 行首（最多 3 个空格）是 ``` 或 ~~~ 时返回围栏字符
+func markdownFence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return ""
+	}
+	for _, fence := range []string{"```", "~~~"} {
+		if strings.HasPrefix(trimmed, fence) {
+			n := len(trimmed) - len(strings.TrimLeft(trimmed, fence[:1]))
+			return strings.Repeat(fence[:1], n)
+		}
+	}
+	return ""
+}
+
+// splitInlineCode 按相同长度的反引号配对切出行内代码，没有配对的反引号按普通文本处理
+func splitInlineCode(s string) []markdownSegment {
+	var res []markdownSegment
+	last := 0
+	for i := 0; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		n := 0
+		for i+n < len(s) && s[i+n] == '`' {
+			n++
+		}
+		tick := s[i : i+n]
+		end := -1
+		for j := i + n; j < len(s); {
+			k := strings.Index(s[j:], tick)
+			if k < 0 {
+				break
+			}
+			k += j
+			m := 0
+			for k+m < len(s) && s[k+m] == '`' {
+				m++
+			}
+			if m == n {
+				end = k + n
+				break
+			}
+			j = k + m
+		}
+		if end < 0 {
+			i += n
+			continue
+		}
+		if i > last {
+			res = append(res, markdownSegment{text: s[last:i]})
+		}
+		res = append(res, markdownSegment{text: s[i:end], code: true})
+		i, last = end, end
+	}
+	if last < len(s) {
+		res = append(res, markdownSegment{text: s[last:]})
+	}
+	return res
+}
@@ -0,0 +1,38 @@
+package oss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteContent(t *testing.T) {
+	ref := NewObject("public", "a.png").EncodeUrl()
+	bad := NewObject("public", "b.png").EncodeUrl()
+	resolve := func(r string) (string, bool) {
+		if r == ref {
+			return "https://cdn.example.com/public/a.png?x=1&y=2", true
+		}
+		return "", false
+	}
+	srcset := func(src string) string {
+		if src == ref {
+			return "https://cdn.example.com/public/a_thumb.png 200w"
+		}
+		return ""
+	}
+
+	html := `<p>hi <img src="` + ref + `" alt="a"> <a href="` + bad + `">b</a> <img src="` + ref + `" srcset="x 1w"/></p>`
+	assert.Equal(t, `<p>hi <img src="https://cdn.example.com/public/a.png?x=1&amp;y=2" alt="a" srcset="https://cdn.example.com/public/a_thumb.png 200w"> <a href="`+bad+`">b</a> <img src="https://cdn.example.com/public/a.png?x=1&amp;y=2" srcset="x 1w"/></p>`,
+		rewriteContent(html, false, resolve, srcset))
+
+	md := "![a](" + ref + " \"t\")\n\n```\n![a](" + ref + ")\n```\n`" + ref + "` [b](" + bad + ")\n[id]: " + ref + "\n"
+	assert.Equal(t, "![a](https://cdn.example.com/public/a.png?x=1&y=2 \"t\")\n\n```\n![a]("+ref+")\n```\n`"+ref+"` [b]("+bad+")\n[id]: https://cdn.example.com/public/a.png?x=1&y=2\n",
+		rewriteContent(md, true, resolve, srcset))
+
+	// 结尾不完整的标签和注释原样保留
+	for _, in := range []string{"hello <b", "hello <img src=\"" + ref, "a <!-- b", "x </", "<"} {
+		assert.Equal(t, in, rewriteContent(in, false, resolve, srcset))
+		assert.Equal(t, in, rewriteContent(in, true, resolve, srcset))
+	}
+}
@@ -0,0 +1,226 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/EICHI-X/ptools/logs"
+	"github.com/EICHI-X/ptools/purl"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultUploadFormField = "file"
+	DefaultUploadMaxFiles  = 9
+)
+
+// UploadHandlerConfig Hertz/Gin 上传接口的公共配置
+type UploadHandlerConfig struct {
+	Loader         *OssLoader
+	Bucket         string
+	KeyPrefix      string       // 未配置 Validator 时按 DefaultUploadRule(KeyPrefix) 校验，对象名为 KeyPrefix + 日期/uuid + 扩展名
+	FormField      string       // 表单字段名，默认 file，多个文件使用同一个字段
+	MaxFiles       int          // 单次最多文件数，默认 9
+	IsPublic       bool         // bucket 是否公开，公开时返回 CDN 或 https 地址，否则返回 EncodeRef 编码的引用
+	Image          *ImageOption // 不为空时图片按该配置压缩并生成变体
+	AllowAnonymous bool         // 是否允许未登录上传
+	// CanUpload 上传权限检查，uid 来自 GetTokenUid，为空时只要求已登录
+	CanUpload func(ctx context.Context, uid string, files []*multipart.FileHeader) error
+}
+
+// UploadedFile 单个文件的上传结果，Encoded 为 base64 编码的 FileInfo，可直接交给 purl.URLProcessor
+type UploadedFile struct {
+	FileInfo *purl.FileInfo `json:"file_info,omitempty"`
+	Encoded  string         `json:"encoded,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func (cfg *UploadHandlerConfig) FormFieldName() string {
+	if cfg.FormField == "" {
+		return DefaultUploadFormField
+	}
+	return cfg.FormField
+}
+
+// CheckUpload 检查登录、权限、文件数和配额，返回对应的 http 状态码
+func (cfg *UploadHandlerConfig) CheckUpload(ctx context.Context, uid string, files []*multipart.FileHeader) (int, error) {
+	if uid == "" && !cfg.AllowAnonymous {
+		return http.StatusUnauthorized, fmt.Errorf("未登录")
+	}
+	maxFiles := cfg.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultUploadMaxFiles
+	}
+	if len(files) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("no file in field %v", cfg.FormFieldName())
+	}
+	if len(files) > maxFiles {
+		return http.StatusBadRequest, fmt.Errorf("too many files, max %v", maxFiles)
+	}
+	if cfg.CanUpload != nil {
+		if err := cfg.CanUpload(ctx, uid, files); err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+	if uid != "" {
+		var total int64
+		for _, fh := range files {
+			total += fh.Size
+		}
+		if err := cfg.Loader.CheckQuotaN(ctx, uid, total, int64(len(files))); err != nil {
+			return http.StatusRequestEntityTooLarge, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// UploadFiles 依次上传文件，单个文件失败记录在对应结果的 Error 中，不影响其他文件
+func (cfg *UploadHandlerConfig) UploadFiles(ctx context.Context, uid string, files []*multipart.FileHeader) []*UploadedFile {
+	res := make([]*UploadedFile, len(files))
+	for i, fh := range files {
+		info, err := cfg.uploadOne(ctx, uid, fh)
+		if err != nil {
+			logs.CtxWarnf(ctx, "upload file %v fail %v", fh.Filename, err)
+			res[i] = &UploadedFile{Error: err.Error()}
+			continue
+		}
+		encoded, err := purl.EncodeFileInfo(info)
+		if err != nil {
+			res[i] = &UploadedFile{Error: err.Error()}
+			continue
+		}
+		res[i] = &UploadedFile{FileInfo: info, Encoded: encoded}
+	}
+	return res
+}
+
+func (cfg *UploadHandlerConfig) uploadOne(ctx context.Context, uid string, fh *multipart.FileHeader) (*purl.FileInfo, error) {
+	if uid != "" {
+		ctx = WithOwner(ctx, uid)
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return cfg.Loader.storeUpload(ctx, &storeTarget{
+		Bucket:      cfg.Bucket,
+		KeyPrefix:   cfg.KeyPrefix,
+		IsPublic:    cfg.IsPublic,
+		Image:       cfg.Image,
+		DefaultRule: DefaultUploadRule(cfg.KeyPrefix),
+	}, file, fh.Filename, fh.Size)
+}
+
+// storeTarget storeUpload 的存储位置和处理方式，上传接口和外链转存共用
+type storeTarget struct {
+	Bucket      string
+	KeyPrefix   string
+	IsPublic    bool
+	Image       *ImageOption
+	DefaultRule *UploadRule // 未配置 OssLoader.Validator 时使用的校验规则
+}
+
+// storeUpload 校验后上传，图片按 Image 压缩并生成变体，记录元数据后返回 FileInfo
+// 其他文件与 UploadFromForm 一致：配置了 Dedup 时按内容去重，配置了 Envelope 时加密保存；图片处理会生成明文变体，不能与 Envelope 同时使用
+func (u *OssLoader) storeUpload(ctx context.Context, t *storeTarget, file io.Reader, filename string, size int64) (*purl.FileInfo, error) {
+	if t.Image != nil && u.Envelope != nil {
+		return nil, fmt.Errorf("image processing not supported with envelope encryption")
+	}
+	validator := u.Validator
+	if validator == nil {
+		validator = NewUploadValidator(t.DefaultRule, nil)
+	}
+	v, err := validator.Validate(ctx, t.Bucket, file, filename, size)
+	if err != nil {
+		return nil, err
+	}
+	reader, objectName, filename, contentType := v.Reader, v.ObjectName, v.Filename, v.ContentType
+
+	if t.Image != nil && isProcessableImage(contentType) {
+		imgRes, err := u.UploadImage(ctx, t.Bucket, objectName, reader, filename, *t.Image)
+		if err != nil {
+			return nil, err
+		}
+		objectName, filename = imgRes.Original.Key, imgRes.File.Filename
+		size = int64(len(imgRes.Image.Data))
+		contentType = imgRes.Image.ContentType
+	} else if d := u.dedupFor(t.Bucket); d != nil {
+		record, _, err := d.Upload(ctx, reader, size, filename, contentType, ownerFromCtx(ctx))
+		if err != nil {
+			return nil, err
+		}
+		objectName, size = record.MinioKey, record.Size
+	} else {
+		info, err := u.putObject(ctx, t.Bucket, objectName, reader, size, minio.PutObjectOptions{ContentType: contentType})
+		if err != nil {
+			return nil, errors.WithMessage(err, "upload fail")
+		}
+		size = info.Size
+		if _, err = u.saveFile(ctx, &Blog_file{
+			Filename:    filename,
+			ContentType: contentType,
+			Url:         u.objectRef(t.Bucket, objectName),
+			Path:        objectName,
+			Bucket:      t.Bucket,
+			Md5:         etagMd5(info.ETag),
+			Prefix:      t.KeyPrefix,
+			MinioKey:    objectName,
+			SaveType:    SaveTypeMinio,
+			Size:        size,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	object := NewObject(t.Bucket, objectName)
+	fileUrl := u.EncodeRef(object, 0)
+	if t.IsPublic {
+		if publicUrl := u.PublicUrl(object); publicUrl != "" {
+			fileUrl = publicUrl
+		}
+	}
+	return &purl.FileInfo{
+		FileName:     filename,
+		Size:         size,
+		URL:          fileUrl,
+		ContentType:  contentType,
+		ProviderName: SaveTypeMinio,
+		UploadTime:   time.Now().Format(time.RFC3339),
+		IsPublic:     t.IsPublic,
+		FilePath:     t.Bucket + "/" + objectName,
+	}, nil
+}
+
+// isProcessableImage gif 和 svg 不走压缩流水线
+func isProcessableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/webp"
+}
+
+func etagMd5(etag string) string {
+	md5Hex := strings.Trim(etag, "\"")
+	if len(md5Hex) != 32 {
+		return ""
+	}
+	return md5Hex
+}
+
+// PublicUrl 公开对象的访问地址，配置了 CDN 时返回 CDN 地址，否则使用选出的 host 拼接地址，UseSSL 为 false 时使用 http
+func (u *OssLoader) PublicUrl(o *Object) string {
+	if cdnUrl, ok := u.Cdn.Rewrite(o); ok {
+		return cdnUrl
+	}
+	obj := *o
+	obj.Host = u.SelectHost(o, u.Region)
+	httpsUrl := obj.EncodeToHttps()
+	if u.UseSSL || httpsUrl == "" {
+		return httpsUrl
+	}
+	return "http://" + strings.TrimPrefix(httpsUrl, "https://")
+}
@@ -0,0 +1,97 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EICHI-X/ptools/paerospike"
+)
+
+const (
+	DefaultUrlCachePsm       = "aerospike.stock.packer"
+	DefaultUrlCacheKeyPrefix = "1000|packer|article."
+)
+
+// UrlCache 签名地址缓存，GetBatch 返回与 keys 等长的结果，未命中为空字符串
+type UrlCache interface {
+	GetBatch(ctx context.Context, keys []string) ([]string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+}
+
+// AerospikeUrlCache 基于 paerospike 的缓存，key 格式必须是 appid|project|key
+type AerospikeUrlCache struct {
+	Client    *paerospike.Client
+	BatchSize int
+}
+
+func NewAerospikeUrlCache(psm string) *AerospikeUrlCache {
+	return &AerospikeUrlCache{Client: paerospike.NewDefaultClient(psm), BatchSize: 100}
+}
+
+func (c *AerospikeUrlCache) GetBatch(ctx context.Context, keys []string) ([]string, error) {
+	if c.Client == nil {
+		return nil, fmt.Errorf("AerospikeUrlCache client is nil")
+	}
+	return c.Client.GetBatch(keys, c.BatchSize)
+}
+
+func (c *AerospikeUrlCache) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if c.Client == nil {
+		return fmt.Errorf("AerospikeUrlCache client is nil")
+	}
+	// aerospike 的 ttl 单位是秒
+	return c.Client.PutAsync(key, value, uint32(ttl/time.Second))
+}
+
+// UrlCacheTtlFunc 根据签名有效期计算缓存时间，<=0 表示不缓存
+type UrlCacheTtlFunc func(expiry time.Duration) time.Duration
+
+// HalfExpiryTtl 缓存签名有效期的一半，保证取出的地址至少还有一半有效期
+func HalfExpiryTtl(expiry time.Duration) time.Duration {
+	return expiry / 2
+}
+
+// UrlCacheConfig GetRealUrlsWithCache 使用的缓存配置
+type UrlCacheConfig struct {
+	Cache     UrlCache        // 为空表示不使用缓存
+	KeyPrefix string          // 缓存 key 前缀，key 为 KeyPrefix + Object.GenKey()
+	Ttl       UrlCacheTtlFunc // 默认 HalfExpiryTtl
+}
+
+func (c *UrlCacheConfig) key(o *Object) string {
+	return c.KeyPrefix + o.GenKey()
+}
+
+func (c *UrlCacheConfig) ttl(expiry time.Duration) time.Duration {
+	if c.Ttl == nil {
+		return HalfExpiryTtl(expiry)
+	}
+	return c.Ttl(expiry)
+}
+
+var (
+	defaultUrlCacheOnce sync.Once
+	defaultUrlCache     *UrlCacheConfig
+)
+
+// WithUrlCache 设置签名地址缓存，不设置时使用 aerospike.stock.packer 集群和 1000|packer|article. 前缀
+func WithUrlCache(cfg *UrlCacheConfig) OssLoaderOption {
+	return func(o *OssLoader) {
+		o.UrlCache = cfg
+	}
+}
+
+func (u *OssLoader) urlCache() *UrlCacheConfig {
+	if u.UrlCache != nil {
+		return u.UrlCache
+	}
+	defaultUrlCacheOnce.Do(func() {
+		defaultUrlCache = &UrlCacheConfig{KeyPrefix: DefaultUrlCacheKeyPrefix, Ttl: HalfExpiryTtl}
+		if client := paerospike.NewDefaultClient(DefaultUrlCachePsm); client != nil {
+			defaultUrlCache.Cache = &AerospikeUrlCache{Client: client, BatchSize: 100}
+		}
+	})
+	return defaultUrlCache
+}
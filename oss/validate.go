@@ -0,0 +1,385 @@
+package oss
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	sniffLen              = 512
+	maxFilenameLen        = 128
+	DefaultScanBufferSize = 32 << 20
+)
+
+var (
+	ErrUploadTooLarge       = errors.New("upload too large")
+	ErrUploadTooSmall       = errors.New("upload too small")
+	ErrUploadTypeNotAllowed = errors.New("upload type not allowed")
+	ErrUploadInfected       = errors.New("upload rejected by scanner")
+)
+
+// UploadRule 单个 bucket 的上传限制
+type UploadRule struct {
+	Bucket          string
+	ContentTypes    []string // 按文件头识别出的类型白名单，如 image/*，为空表示不限制
+	Extensions      []string // 扩展名白名单，如 .jpg，为空表示不限制
+	StrictExtension bool     // 扩展名对应的类型必须与识别出的类型一致
+	MinSize         int64
+	MaxSize         int64  // <=0 表示不限制
+	KeyPrefix       string // 对象名前缀
+	RandomizeName   bool   // 对象名使用 KeyPrefix + 日期/uuid + 扩展名，不使用客户端文件名
+}
+
+// DefaultUploadContentTypes 没有配置 Validator 时上传接口允许的类型：常见图片和 pdf，不包括 html、svg 等浏览器会执行脚本的类型
+var DefaultUploadContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "application/pdf"}
+
+// DefaultUploadRule 按 DefaultUploadContentTypes 校验，对象名使用 keyPrefix + 日期/uuid + 扩展名
+func DefaultUploadRule(keyPrefix string) *UploadRule {
+	return &UploadRule{
+		ContentTypes:  DefaultUploadContentTypes,
+		KeyPrefix:     keyPrefix,
+		RandomizeName: true,
+	}
+}
+
+// ScanResult 扫描结果，Clean 为 false 时 Signature 为命中的特征
+type ScanResult struct {
+	Clean     bool
+	Signature string
+}
+
+// Scanner 文件存储前的内容扫描，如病毒扫描
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+// ScannerFunc 函数形式的 Scanner
+type ScannerFunc func(ctx context.Context, r io.Reader) (*ScanResult, error)
+
+func (f ScannerFunc) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	return f(ctx, r)
+}
+
+// UploadValidator 上传前校验：识别真实类型、检查白名单和大小、生成安全的对象名并扫描内容
+type UploadValidator struct {
+	Default        *UploadRule // 没有单独配置的 bucket 使用，为空表示不限制
+	Scanner        Scanner
+	ScanBufferSize int64 // 不可 seek 且没有 MaxSize 的流扫描时最多缓存的字节数，默认 32M
+	rules          sync.Map
+}
+
+func NewUploadValidator(defaultRule *UploadRule, scanner Scanner) *UploadValidator {
+	return &UploadValidator{Default: defaultRule, Scanner: scanner}
+}
+
+// SetRule 设置 bucket 的上传限制
+func (v *UploadValidator) SetRule(rule *UploadRule) *UploadValidator {
+	v.rules.Store(rule.Bucket, rule)
+	return v
+}
+
+func (v *UploadValidator) Rule(bucket string) *UploadRule {
+	if r, ok := v.rules.Load(bucket); ok {
+		return r.(*UploadRule)
+	}
+	if v.Default != nil {
+		return v.Default
+	}
+	return &UploadRule{}
+}
+
+// ValidatedUpload 校验通过后用于上传的内容，Reader 必须替代原来的 reader 使用
+type ValidatedUpload struct {
+	Reader      io.Reader
+	ObjectName  string
+	Filename    string // 清理后的原始文件名
+	ContentType string // 按文件头识别出的类型
+	Size        int64
+}
+
+// Validate 校验上传内容，size 未知时传 -1
+func (v *UploadValidator) Validate(ctx context.Context, bucket string, file io.Reader, filename string, size int64) (*ValidatedUpload, error) {
+	rule := v.Rule(bucket)
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return nil, errors.WithMessage(ErrUploadTooLarge, fmt.Sprintf("size %v more than %v", size, rule.MaxSize))
+	}
+	if size >= 0 && size < rule.MinSize {
+		return nil, errors.WithMessage(ErrUploadTooSmall, fmt.Sprintf("size %v less than %v", size, rule.MinSize))
+	}
+	filename = SanitizeFilename(filename)
+	ext := strings.ToLower(path.Ext(filename))
+	if len(rule.Extensions) > 0 && !containsFold(rule.Extensions, ext) {
+		return nil, errors.WithMessage(ErrUploadTypeNotAllowed, fmt.Sprintf("extension %v", ext))
+	}
+
+	seeker, seekable := file.(io.ReadSeeker)
+	contentType, reader, err := SniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+	if !contentTypeAllowed(rule.ContentTypes, contentType) {
+		return nil, errors.WithMessage(ErrUploadTypeNotAllowed, fmt.Sprintf("content type %v", contentType))
+	}
+	if rule.StrictExtension {
+		extType := baseContentType(mime.TypeByExtension(ext))
+		if extType != contentType {
+			return nil, errors.WithMessage(ErrUploadTypeNotAllowed, fmt.Sprintf("extension %v not match content type %v", ext, contentType))
+		}
+	}
+	if rule.MaxSize > 0 {
+		reader = &maxBytesReader{r: reader, remain: rule.MaxSize}
+	}
+
+	if v.Scanner != nil {
+		if reader, err = v.scan(ctx, rule, reader, seeker, seekable); err != nil {
+			return nil, err
+		}
+	}
+
+	objectName := rule.KeyPrefix + filename
+	if rule.RandomizeName {
+		objectName = RandomObjectName(rule.KeyPrefix, ext)
+	}
+	return &ValidatedUpload{
+		Reader:      reader,
+		ObjectName:  objectName,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+	}, nil
+}
+
+// scan 可以 seek 的文件扫描后回到开头，否则缓存到内存中扫描
+func (v *UploadValidator) scan(ctx context.Context, rule *UploadRule, reader io.Reader, seeker io.ReadSeeker, seekable bool) (io.Reader, error) {
+	var scanReader io.Reader
+	if seekable {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		scanReader = seeker
+		if rule.MaxSize > 0 {
+			scanReader = &maxBytesReader{r: seeker, remain: rule.MaxSize}
+		}
+	} else {
+		limit := rule.MaxSize
+		if limit <= 0 {
+			limit = v.ScanBufferSize
+		}
+		if limit <= 0 {
+			limit = DefaultScanBufferSize
+		}
+		data, err := io.ReadAll(&maxBytesReader{r: reader, remain: limit})
+		if err != nil {
+			return nil, err
+		}
+		scanReader = bytes.NewReader(data)
+		reader = bytes.NewReader(data)
+	}
+	res, err := v.Scanner.Scan(ctx, scanReader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "scan upload fail")
+	}
+	if res == nil || !res.Clean {
+		signature := ""
+		if res != nil {
+			signature = res.Signature
+		}
+		return nil, errors.WithMessage(ErrUploadInfected, signature)
+	}
+	if seekable {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		reader = seeker
+		if rule.MaxSize > 0 {
+			reader = &maxBytesReader{r: seeker, remain: rule.MaxSize}
+		}
+	}
+	return reader, nil
+}
+
+// validateUpload 检查配额，配置了 Validator 时校验表单文件，更新 fileObj 的文件名和 Content-Type，返回用于上传的 reader 和对象名
+func (u *OssLoader) validateUpload(ctx context.Context, bucket string, file io.Reader, fileObj *multipart.FileHeader) (io.Reader, string, error) {
+	if err := u.CheckQuota(ctx, "", fileObj.Size); err != nil {
+		return nil, "", err
+	}
+	return u.validateContent(ctx, bucket, file, fileObj)
+}
+
+// validateContent 只校验类型、大小并扫描内容，不检查配额，用于去重上传在算出 md5 之后再检查配额
+func (u *OssLoader) validateContent(ctx context.Context, bucket string, file io.Reader, fileObj *multipart.FileHeader) (io.Reader, string, error) {
+	if u.Validator == nil {
+		return file, fileObj.Filename, nil
+	}
+	res, err := u.Validator.Validate(ctx, bucket, file, fileObj.Filename, fileObj.Size)
+	if err != nil {
+		return nil, "", err
+	}
+	if fileObj.Header == nil {
+		fileObj.Header = textproto.MIMEHeader{}
+	}
+	fileObj.Filename = res.Filename
+	fileObj.Header.Set("Content-Type", res.ContentType)
+	return res.Reader, res.ObjectName, nil
+}
+
+// SniffContentType 根据前 512 字节识别真实类型，返回的 reader 包含已读取的部分
+func SniffContentType(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return baseContentType(http.DetectContentType(head)), io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// SanitizeFilename 去掉路径和控制字符，只保留字母、数字(包括中文)和 ._-，长度不超过 128
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_':
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune('_')
+		}
+	}
+	name = strings.TrimLeft(b.String(), ".")
+	if runes := []rune(name); len(runes) > maxFilenameLen {
+		ext := path.Ext(name)
+		if len([]rune(ext)) >= maxFilenameLen {
+			ext = ""
+		}
+		name = string(runes[:maxFilenameLen-len([]rune(ext))]) + ext
+	}
+	if name == "" || name == "." {
+		name = "file"
+	}
+	return name
+}
+
+// RandomObjectName 生成 prefix/yyyy/mm/dd/uuid.ext 格式的对象名
+func RandomObjectName(prefix string, ext string) string {
+	return prefix + time.Now().Format("2006/01/02/") + uuid.NewString() + strings.ToLower(ext)
+}
+
+func containsFold(list []string, v string) bool {
+	for _, i := range list {
+		if strings.EqualFold(i, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBytesReader 读取超过 remain 字节时返回 ErrUploadTooLarge
+type maxBytesReader struct {
+	r      io.Reader
+	remain int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remain < 0 {
+		return 0, ErrUploadTooLarge
+	}
+	// 多读一个字节用于判断是否超出
+	if int64(len(p)) > m.remain+1 {
+		p = p[:m.remain+1]
+	}
+	n, err := m.r.Read(p)
+	m.remain -= int64(n)
+	if m.remain < 0 {
+		return n + int(m.remain), ErrUploadTooLarge
+	}
+	return n, err
+}
+
+// ClamdScanner 通过 clamd 的 INSTREAM 协议扫描，Network 为 tcp 或 unix
+type ClamdScanner struct {
+	Network   string
+	Address   string
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+func NewClamdScanner(network string, address string) *ClamdScanner {
+	return &ClamdScanner{Network: network, Address: address, Timeout: time.Minute, ChunkSize: 64 << 10}
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "ClamdScanner dial fail")
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 << 10
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply 返回格式为 stream: OK 或 stream: Eicar-Signature FOUND
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return &ScanResult{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Clean: false, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return nil, fmt.Errorf("ClamdScanner reply not valid %v", reply)
+}
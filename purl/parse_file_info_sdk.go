@@ -21,8 +21,20 @@ type FileInfo struct {
 	IsPublic     bool   `json:"is_public"` // 是否为公开文件
 	FilePath     string `json:"file_path"` // endpoint后面的路径，如：aipurchase/public/test_public.txt
 }
+// RefResolver 把文件引用解析为可访问的地址，oss.OssLoader 实现了该接口，支持 oref:v1 签名引用、ostart 编码和 FileInfo 元数据
+type RefResolver interface {
+	ResolveRef(ctx context.Context, ref string) (string, error)
+}
+
 // URLProcessor SDK用于处理URL
-type URLProcessor struct{}
+type URLProcessor struct {
+	Resolver RefResolver // 为空时只能解析 FileInfo 元数据
+}
+
+// NewURLProcessorWithResolver 创建使用 resolver 解析文件引用的URL处理器
+func NewURLProcessorWithResolver(resolver RefResolver) *URLProcessor {
+	return &URLProcessor{Resolver: resolver}
+}
 
 // NewURLProcessor 创建URL处理器实例
 func NewURLProcessor() *URLProcessor {
@@ -31,6 +43,7 @@ func NewURLProcessor() *URLProcessor {
 var UrlFIleProcessor *URLProcessor = NewURLProcessor()
 // ProcessURL 处理URL
 // 如果URL以http开头，则直接返回
+// 设置了 Resolver 时由 Resolver 解析所有格式的文件引用
 // 如果URL是base64编码的元数据，则解析并返回其中的URL字段
 func (p *URLProcessor) ProcessURL(ctx context.Context, input string) (string) {
 	// 检查是否是http开头的URL
@@ -38,6 +51,15 @@ func (p *URLProcessor) ProcessURL(ctx context.Context, input string) (string) {
 		return input
 	}
 
+	if p.Resolver != nil {
+		url, err := p.Resolver.ResolveRef(ctx, input)
+		if err == nil {
+			return url
+		}
+		logs.CtxWarnf(ctx, "ResolveRef fail %v", err)
+		return ""
+	}
+
 	// 尝试解析为base64编码的元数据
 	fileInfo, err := p.decodeFileMetadata(input)
 	if err != nil {
@@ -66,3 +88,12 @@ func (p *URLProcessor) decodeFileMetadata(encodedData string) (*FileInfo, error)
 
 	return &fileInfo, nil
 }
+
+// EncodeFileInfo 把文件信息编码为 base64 元数据，ProcessURL 可以解析
+func EncodeFileInfo(fileInfo *FileInfo) (string, error) {
+	jsonData, err := json.Marshal(fileInfo)
+	if err != nil {
+		return "", fmt.Errorf("序列化JSON失败: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(jsonData), nil
+}